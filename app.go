@@ -1,27 +1,203 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"github.com/blang/crane/auth"
+	"github.com/blang/crane/notify"
 	"github.com/blang/crane/store"
-	"log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
-	listen := flag.String("listen", ":5000", "Addr to listen on")
-	dataDir := flag.String("datadir", "/tmp/registry", "Data directory")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			os.Exit(migrateCommand(os.Args[2:]))
+		case "fsck":
+			os.Exit(fsckCommand(os.Args[2:]))
+		}
+	}
+	configFile := flag.String("config", "", "YAML config file")
+	listen := flag.String("listen", "", "Addr to listen on, overrides config")
+	dataDir := flag.String("datadir", "", "Data directory, overrides config")
 	flag.Parse()
 
-	metaStorage := store.NewMemMetaStorage()
-	fileStorage := store.NewLocalFileStorage(*dataDir)
+	config, err := LoadConfig(*configFile)
+	if err == nil {
+		err = config.ApplyEnv(os.Environ())
+	}
+	if err == nil {
+		if *listen != "" {
+			config.Listen = *listen
+		}
+		if *dataDir != "" {
+			config.DataDir = *dataDir
+		}
+		err = config.Validate()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	log, err := NewLogger(config.Log.Level, config.Log.Format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create logger: %v\n", err)
+		os.Exit(2)
+	}
+
+	metaStorage, fileStorage, err := buildStorage(config, log)
+	if err != nil {
+		log.Fatalf("Could not create storage: %v", err)
+	}
 	authenticator := auth.NewLocalAuthenticator()
-	proxyStore := store.NewProxyStore(metaStorage, fileStorage)
-	registry := NewRegistry(proxyStore, authenticator)
-	api := NewRegistryAPI(registry)
+	authenticator.SetAdmins(config.Authenticator.Admins)
+	metrics := NewMetrics(prometheus.DefaultRegisterer)
+	if config.Cache.Size > 0 {
+		maxItemSize := config.Cache.MaxItemSize
+		if maxItemSize == 0 {
+			maxItemSize = config.Cache.Size / 16
+		}
+		cache := store.NewCache(config.Cache.Size, maxItemSize)
+		metrics.InstrumentCache(cache)
+		metaStorage = store.NewCachedMetaStorage(metaStorage, cache)
+		fileStorage = store.NewCachedFileStorage(fileStorage, cache)
+	}
+	proxyStore := metrics.InstrumentStore(store.NewProxyStore(metaStorage, fileStorage))
+	registry := NewRegistry(proxyStore, authenticator, log)
+	registry.SetTagRules(config.TagRules)
+	registry.SetQuotas(config.Quotas)
+	registry.SetUploadLimits(config.Uploads, config.DriverOptions(config.Storage)["datadir"])
+	metrics.InstrumentRegistry(registry)
+	if len(config.Webhooks.Endpoints) > 0 {
+		cipher, err := store.NewRecordCipher(config.DriverOptions(config.Storage))
+		if err != nil {
+			log.Fatalf("Could not load webhook outbox encryption key: %v", err)
+		}
+		outbox, err := notify.NewOutbox(config.WebhookOutbox(), cipher, log)
+		if err != nil {
+			log.Fatalf("Could not create webhook outbox: %v", err)
+		}
+		webhooks := notify.NewWebhookNotifier(config.Webhooks.Endpoints, outbox, log)
+		webhooks.Start()
+		registry.SetWebhooks(webhooks)
+	}
+	if len(config.Retention.Rules) > 0 {
+		if err := registry.SetRetentionRules(config.Retention.Rules); err != nil {
+			log.Fatalf("Invalid retention rules: %v", err)
+		}
+		go func() {
+			for _ = range time.Tick(config.Retention.Interval) {
+				if registry.ReadOnly().ReadOnly {
+					log.Info("Registry is read-only, skipping retention")
+					continue
+				}
+				report := registry.ApplyRetention(config.Retention.DryRun)
+				log.WithFields(logrus.Fields{"tags": len(report.Tags), "images": len(report.Images), "dry_run": report.DryRun}).Info("Retention applied")
+			}
+		}()
+	}
+	if config.Scrub.Interval > 0 {
+		go func() {
+			for _ = range time.Tick(config.Scrub.Interval) {
+				// Corrupted layers are only reported while the registry is read-only
+				report := registry.Scrub(config.Scrub.Quarantine && !registry.ReadOnly().ReadOnly)
+				entry := log.WithFields(logrus.Fields{"images": report.Images, "issues": len(report.Issues), "quarantined": len(report.Quarantined)})
+				if len(report.Issues) > 0 {
+					entry.Warn("Scrub found issues")
+				} else {
+					entry.Info("Scrub complete")
+				}
+			}
+		}()
+	}
+	handleReadOnlySignals(registry)
+	api := NewRegistryAPI(registry, log)
+	api.SetEndpoints(config.Endpoints)
+	if config.RateLimits.Enabled() {
+		api.SetRateLimiter(NewRateLimiter(config.RateLimits))
+	}
 
-	log.Printf("Starting server listening on %q", *listen)
-	if err := http.ListenAndServe(*listen, api); err != nil {
+	go func() {
+		for _ = range time.Tick(time.Minute) {
+			// Clients can not continue their pushes while the registry is read-only
+			if registry.ReadOnly().ReadOnly {
+				continue
+			}
+			registry.ExpirePushSessions(config.PushTimeout)
+		}
+	}()
+
+	handler := http.NewServeMux()
+	handler.Handle("/metrics", promhttp.Handler())
+	handler.Handle("/", metrics.InstrumentAPI(api))
+
+	server := &http.Server{
+		Addr:    config.Listen,
+		Handler: handler,
+	}
+	server.RegisterOnShutdown(registry.CloseEventStreams)
+	if config.TLS.Cert != "" {
+		server.TLSConfig, err = NewTLSConfig(config.TLS, log)
+		if err != nil {
+			log.Fatalf("Could not configure TLS: %v", err)
+		}
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		log.WithField("listen", config.Listen).Info("Starting server")
+		if server.TLSConfig != nil {
+			serverErr <- server.ListenAndServeTLS("", "")
+		} else {
+			serverErr <- server.ListenAndServe()
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serverErr:
 		log.Fatalf("HTTP Server crashed: %v", err)
+	case sig := <-signals:
+		log.WithField("signal", sig).Info("Shutting down")
+	}
+	shutdown(server, registry, config.ShutdownGrace, log)
+}
+
+// Stops accepting requests, waits up to grace for in-flight requests like layer uploads,
+// then closes the remaining connections. The registry waits for their handlers to return
+// before it discards unfinished uploads and flushes the store.
+func shutdown(server *http.Server, registry *Registry, grace time.Duration, log logrus.FieldLogger) {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warnf("Requests still running after %s, closing connections: %v", grace, err)
+		server.Close()
+	}
+	if err := registry.Shutdown(); err != nil {
+		log.Errorf("Could not flush store: %v", err)
+	}
+	log.Info("Shutdown complete")
+}
+
+// Creates the metadata and file storage drivers selected by config
+func buildStorage(config *Config, log logrus.FieldLogger) (store.MetaStorage, store.FileStorage, error) {
+	metaStorage, err := store.NewMetaStorage(config.Metadata.Driver, config.DriverOptions(config.Metadata), log)
+	if err != nil {
+		return nil, nil, fmt.Errorf("metadata driver %s: %v", config.Metadata.Driver, err)
+	}
+	fileStorage, err := store.NewFileStorage(config.Storage.Driver, config.DriverOptions(config.Storage), log)
+	if err != nil {
+		return nil, nil, fmt.Errorf("storage driver %s: %v", config.Storage.Driver, err)
 	}
+	return metaStorage, fileStorage, nil
 }
@@ -1,5 +1,7 @@
 package auth
 
+import "crypto/x509"
+
 type Mode int
 
 const (
@@ -9,6 +11,7 @@ const (
 
 type Authenticator interface {
 	Authenticate(user string, pass string) bool
+	AuthenticateCertificate(cert *x509.Certificate) (string, bool)
 	Authorize(user, pass, namespace, repository string, imageIDs []string, mode Mode) (string, bool)
 	HasPermPushImage(token string, imageID string) bool
 	HasPermPullImage(token string, imageID string) bool
@@ -16,4 +19,8 @@ type Authenticator interface {
 	HasPermPullTag(token string, namespace, repository string, tag string) bool
 	HasPermPullTags(token string, namespace, repository string) bool
 	HasPermPushChecksums(token string, namespace, repository string) bool
+	TokenUser(token string) (string, bool)
+	TokenNamespace(token string) (string, bool)
+	IsAdmin(user string) bool
+	HasPermNamespace(user string, namespace string) bool
 }
@@ -2,23 +2,26 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/x509"
 	"encoding/base64"
 )
 
 type tokenPerm struct {
+	user       string
 	namespace  string
 	repository string
 	images     map[string]bool
 	mode       Mode
 }
 
-func newAuthToken(namespace, repository string, images []string, mode Mode) (*tokenPerm, string) {
+func newAuthToken(user, namespace, repository string, images []string, mode Mode) (*tokenPerm, string) {
 	imap := make(map[string]bool)
 	for _, i := range images {
 		imap[i] = true
 	}
 	token := createRandomToken()
 	return &tokenPerm{
+		user:       user,
 		namespace:  namespace,
 		repository: repository,
 		images:     imap,
@@ -34,26 +37,54 @@ func createRandomToken() string {
 
 type LocalAuthenticator struct {
 	tokenMap map[string]*tokenPerm
+	admins   map[string]bool
 }
 
 //TODO: Cleanup map
 func NewLocalAuthenticator() *LocalAuthenticator {
 	return &LocalAuthenticator{
 		tokenMap: make(map[string]*tokenPerm),
+		admins:   make(map[string]bool),
 	}
 }
 
+// Grant admin operations to users
+func (l *LocalAuthenticator) SetAdmins(users []string) {
+	admins := make(map[string]bool)
+	for _, user := range users {
+		admins[user] = true
+	}
+	l.admins = admins
+}
+
+func (l *LocalAuthenticator) IsAdmin(user string) bool {
+	return l.admins[user]
+}
+
+// Users may access their own namespace, admins every namespace
+func (l *LocalAuthenticator) HasPermNamespace(user string, namespace string) bool {
+	return user == namespace || l.IsAdmin(user)
+}
+
 // Authenticate all users, because this is already done by proxy
 func (l *LocalAuthenticator) Authenticate(user string, pass string) bool {
 	return true
 }
 
+// Maps a verified client certificate to the user of its common name
+func (l *LocalAuthenticator) AuthenticateCertificate(cert *x509.Certificate) (string, bool) {
+	if cert.Subject.CommonName == "" {
+		return "", false
+	}
+	return cert.Subject.CommonName, true
+}
+
 // Grant access to users namespace only
 func (l *LocalAuthenticator) Authorize(user, pass, namespace, repository string, imageIDs []string, mode Mode) (string, bool) {
 	if user != namespace {
 		return "", false
 	}
-	tokenPerm, token := newAuthToken(namespace, repository, imageIDs, mode)
+	tokenPerm, token := newAuthToken(user, namespace, repository, imageIDs, mode)
 	l.tokenMap[token] = tokenPerm
 	return token, true
 }
@@ -144,3 +175,21 @@ func (l *LocalAuthenticator) HasPermPushChecksums(token string, namespace, repos
 	}
 	return true
 }
+
+// Returns the namespace the token was issued for
+func (l *LocalAuthenticator) TokenNamespace(token string) (string, bool) {
+	perm, found := l.tokenMap[token]
+	if !found {
+		return "", false
+	}
+	return perm.namespace, true
+}
+
+// Returns the user the token was issued to
+func (l *LocalAuthenticator) TokenUser(token string) (string, bool) {
+	perm, found := l.tokenMap[token]
+	if !found {
+		return "", false
+	}
+	return perm.user, true
+}
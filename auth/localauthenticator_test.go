@@ -127,6 +127,17 @@ func TestPerms(t *testing.T) {
 		t.Error("Read token grants pull tags of invalid namespace")
 	}
 
+	// Token user
+	if user, found := auth.TokenUser(writeToken); !found || user != USER {
+		t.Errorf("Token user of write token is %q, expected %q", user, USER)
+	}
+	if _, found := auth.TokenUser("invalid"); found {
+		t.Error("Token user found for invalid token")
+	}
+	if namespace, found := auth.TokenNamespace(writeToken); !found || namespace != NAMESPACE {
+		t.Errorf("Token namespace of write token is %q, expected %q", namespace, NAMESPACE)
+	}
+
 	// Push checksums
 	if !auth.HasPermPushChecksums(writeToken, NAMESPACE, REPOSITORY) {
 		t.Error("Write token does not grant push checksums")
@@ -143,3 +154,26 @@ func TestPerms(t *testing.T) {
 		t.Error("Read token grants push checksums to invalid namespace")
 	}
 }
+
+func TestIsAdmin(t *testing.T) {
+	auth := NewLocalAuthenticator()
+	if auth.IsAdmin("admin") {
+		t.Error("User is admin without configuration")
+	}
+	auth.SetAdmins([]string{"admin"})
+	if !auth.IsAdmin("admin") {
+		t.Error("Configured admin is not admin")
+	}
+	if auth.IsAdmin("user") {
+		t.Error("User is admin")
+	}
+	if !auth.HasPermNamespace("admin", "user") {
+		t.Error("Admin has no permission on namespace of user")
+	}
+	if !auth.HasPermNamespace("user", "user") {
+		t.Error("User has no permission on own namespace")
+	}
+	if auth.HasPermNamespace("user", "another") {
+		t.Error("User has permission on another namespace")
+	}
+}
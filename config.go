@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/blang/crane/notify"
+	"github.com/blang/crane/store"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+// Config describes a crane server, read from a yaml file
+type Config struct {
+	Listen        string              `yaml:"listen"`
+	DataDir       string              `yaml:"datadir"`   // State like the webhook outbox, default for storage options
+	Endpoints     []string            `yaml:"endpoints"` // Value of X-Docker-Endpoints, defaults to the request host
+	TLS           TLSConfig           `yaml:"tls"`
+	Log           LogConfig           `yaml:"log"`
+	Storage       DriverConfig        `yaml:"storage"`
+	Metadata      DriverConfig        `yaml:"metadata"`
+	Authenticator AuthenticatorConfig `yaml:"authenticator"`
+	PushTimeout   time.Duration       `yaml:"push_timeout"`
+	ShutdownGrace time.Duration       `yaml:"shutdown_grace"` // Time in-flight requests get to finish on shutdown
+	TagRules      []TagRule           `yaml:"tag_rules"`
+	Retention     RetentionConfig     `yaml:"retention"`
+	Quotas        Quotas              `yaml:"quotas"`
+	Webhooks      WebhooksConfig      `yaml:"webhooks"`
+	Scrub         ScrubConfig         `yaml:"scrub"`
+	Cache         CacheConfig         `yaml:"cache"`
+	RateLimits    RateLimitConfig     `yaml:"rate_limits"`
+	Uploads       UploadLimits        `yaml:"uploads"`
+}
+
+// Serves TLS if cert and key are set, both files are reloaded when they change.
+// Client certificates signed by client_ca authenticate the user of their common name.
+type TLSConfig struct {
+	Cert       string `yaml:"cert"`
+	Key        string `yaml:"key"`
+	ClientCA   string `yaml:"client_ca"`
+	ClientAuth string `yaml:"client_auth"` // optional or require, defaults to optional
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+// Selects a storage or metadata backend by name with backend specific options
+type DriverConfig struct {
+	Driver  string            `yaml:"driver"`
+	Options map[string]string `yaml:"options"`
+}
+
+type AuthenticatorConfig struct {
+	Driver string   `yaml:"driver"`
+	Admins []string `yaml:"admins"`
+}
+
+type RetentionConfig struct {
+	Interval time.Duration   `yaml:"interval"`
+	DryRun   bool            `yaml:"dry_run"`
+	Rules    []RetentionRule `yaml:"rules"`
+}
+
+type WebhooksConfig struct {
+	Outbox    string            `yaml:"outbox"` // Defaults to datadir/outbox, encrypted with the storage encryption_keyfile
+	Endpoints []notify.Endpoint `yaml:"endpoints"`
+}
+
+// Re-hashes all layers every interval, a zero interval disables the background scrubber
+type ScrubConfig struct {
+	Interval   time.Duration `yaml:"interval"`
+	Quarantine bool          `yaml:"quarantine"`
+}
+
+// Keeps small layers and image json in memory, a zero size disables the cache
+type CacheConfig struct {
+	Size        int64 `yaml:"size"`          // Bytes
+	MaxItemSize int64 `yaml:"max_item_size"` // Bytes of the largest cached layer, defaults to 1/16 of size
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Listen:  ":5000",
+		DataDir: "/tmp/registry",
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Storage: DriverConfig{
+			Driver:  "local",
+			Options: make(map[string]string),
+		},
+		Metadata: DriverConfig{
+			Driver:  "memory",
+			Options: make(map[string]string),
+		},
+		Authenticator: AuthenticatorConfig{
+			Driver: "local",
+		},
+		PushTimeout:   time.Hour,
+		ShutdownGrace: 30 * time.Second,
+		Retention: RetentionConfig{
+			Interval: 24 * time.Hour,
+		},
+	}
+}
+
+// Reads the config file on top of the defaults, an empty filename only uses the defaults
+func LoadConfig(filename string) (*Config, error) {
+	config := DefaultConfig()
+	if filename == "" {
+		return config, nil
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(b, config); err != nil {
+		return nil, fmt.Errorf("Could not parse config %s: %v", filename, err)
+	}
+	return config, nil
+}
+
+// Overrides settings from environment variables:
+// CRANE_LISTEN, CRANE_DATADIR, CRANE_ENDPOINTS (comma separated), CRANE_TLS_CERT, CRANE_TLS_KEY,
+// CRANE_TLS_CLIENT_CA, CRANE_TLS_CLIENT_AUTH,
+// CRANE_LOG_LEVEL, CRANE_LOG_FORMAT, CRANE_STORAGE_DRIVER, CRANE_METADATA_DRIVER, CRANE_AUTHENTICATOR_DRIVER,
+// CRANE_ADMINS (comma separated), CRANE_PUSH_TIMEOUT, CRANE_SHUTDOWN_GRACE and driver options as
+// CRANE_STORAGE_OPTION_<NAME> and CRANE_METADATA_OPTION_<NAME>.
+func (c *Config) ApplyEnv(environ []string) error {
+	strs := map[string]*string{
+		"CRANE_LISTEN":               &c.Listen,
+		"CRANE_DATADIR":              &c.DataDir,
+		"CRANE_TLS_CERT":             &c.TLS.Cert,
+		"CRANE_TLS_KEY":              &c.TLS.Key,
+		"CRANE_TLS_CLIENT_CA":        &c.TLS.ClientCA,
+		"CRANE_TLS_CLIENT_AUTH":      &c.TLS.ClientAuth,
+		"CRANE_LOG_LEVEL":            &c.Log.Level,
+		"CRANE_LOG_FORMAT":           &c.Log.Format,
+		"CRANE_STORAGE_DRIVER":       &c.Storage.Driver,
+		"CRANE_METADATA_DRIVER":      &c.Metadata.Driver,
+		"CRANE_AUTHENTICATOR_DRIVER": &c.Authenticator.Driver,
+	}
+	durations := map[string]*time.Duration{
+		"CRANE_PUSH_TIMEOUT":   &c.PushTimeout,
+		"CRANE_SHUTDOWN_GRACE": &c.ShutdownGrace,
+	}
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "CRANE_") {
+			continue
+		}
+		key, value := parts[0], parts[1]
+		if s, found := strs[key]; found {
+			*s = value
+			continue
+		}
+		if d, found := durations[key]; found {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("Invalid %s: %v", key, err)
+			}
+			*d = parsed
+			continue
+		}
+		switch {
+		case key == "CRANE_ENDPOINTS":
+			c.Endpoints = splitList(value)
+		case key == "CRANE_ADMINS":
+			c.Authenticator.Admins = splitList(value)
+		case strings.HasPrefix(key, "CRANE_STORAGE_OPTION_"):
+			setOption(&c.Storage, strings.TrimPrefix(key, "CRANE_STORAGE_OPTION_"), value)
+		case strings.HasPrefix(key, "CRANE_METADATA_OPTION_"):
+			setOption(&c.Metadata, strings.TrimPrefix(key, "CRANE_METADATA_OPTION_"), value)
+		}
+	}
+	return nil
+}
+
+// Checks the config for errors, all problems are reported at once
+func (c *Config) Validate() error {
+	var errs []string
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if c.Listen == "" {
+		check(errors.New("listen is empty"))
+	}
+	if c.DataDir == "" {
+		check(errors.New("datadir is empty"))
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		check(errors.New("tls needs both cert and key"))
+	}
+	if c.TLS.ClientCA != "" && c.TLS.Cert == "" {
+		check(errors.New("tls: client_ca needs cert and key"))
+	}
+	switch c.TLS.ClientAuth {
+	case "", "optional", "require":
+	default:
+		check(fmt.Errorf("tls: unknown client_auth %q", c.TLS.ClientAuth))
+	}
+	if _, err := NewLogger(c.Log.Level, c.Log.Format); err != nil {
+		check(fmt.Errorf("log: %v", err))
+	}
+	if !contains(store.FileStorageDrivers(), c.Storage.Driver) {
+		check(fmt.Errorf("storage: unknown driver %q, available: %s", c.Storage.Driver, strings.Join(store.FileStorageDrivers(), ", ")))
+	}
+	if !contains(store.MetaStorageDrivers(), c.Metadata.Driver) {
+		check(fmt.Errorf("metadata: unknown driver %q, available: %s", c.Metadata.Driver, strings.Join(store.MetaStorageDrivers(), ", ")))
+	}
+	switch c.Authenticator.Driver {
+	case "local":
+	default:
+		check(fmt.Errorf("authenticator: unknown driver %q", c.Authenticator.Driver))
+	}
+	if c.PushTimeout <= 0 {
+		check(errors.New("push_timeout must be positive"))
+	}
+	if c.ShutdownGrace < 0 {
+		check(errors.New("shutdown_grace must not be negative"))
+	}
+	if c.Scrub.Interval < 0 {
+		check(errors.New("scrub: interval must not be negative"))
+	}
+	if c.Cache.Size < 0 || c.Cache.MaxItemSize < 0 {
+		check(errors.New("cache: size and max_item_size must not be negative"))
+	}
+	if err := c.RateLimits.Validate(); err != nil {
+		check(fmt.Errorf("rate_limits: %v", err))
+	}
+	if err := c.Uploads.Validate(); err != nil {
+		check(fmt.Errorf("uploads: %v", err))
+	}
+	if len(c.Retention.Rules) > 0 && c.Retention.Interval <= 0 {
+		check(errors.New("retention: interval must be positive"))
+	}
+	if err := ValidateTagRules(c.TagRules); err != nil {
+		check(fmt.Errorf("tag_rules: %v", err))
+	}
+	if err := ValidateRetentionRules(c.Retention.Rules); err != nil {
+		check(fmt.Errorf("retention: %v", err))
+	}
+	if err := c.Quotas.Validate(); err != nil {
+		check(fmt.Errorf("quotas: %v", err))
+	}
+	if err := notify.ValidateEndpoints(c.Webhooks.Endpoints); err != nil {
+		check(fmt.Errorf("webhooks: %v", err))
+	}
+	if len(errs) > 0 {
+		return errors.New("Invalid config: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Returns a copy of the driver options, the datadir option defaults to the global datadir
+func (c *Config) DriverOptions(d DriverConfig) map[string]string {
+	options := map[string]string{"datadir": c.DataDir}
+	for name, value := range d.Options {
+		if value != "" {
+			options[name] = value
+		}
+	}
+	return options
+}
+
+func (c *Config) WebhookOutbox() string {
+	if c.Webhooks.Outbox != "" {
+		return c.Webhooks.Outbox
+	}
+	return path.Join(c.DataDir, "outbox")
+}
+
+func setOption(d *DriverConfig, name string, value string) {
+	if d.Options == nil {
+		d.Options = make(map[string]string)
+	}
+	d.Options[strings.ToLower(name)] = value
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
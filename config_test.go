@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "crane-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func TestLoadConfig(t *testing.T) {
+	filename := writeTestConfig(t, `
+listen: ":6000"
+endpoints: [registry.example.com]
+storage:
+  driver: local
+  options:
+    datadir: /var/lib/crane
+authenticator:
+  admins: [admin]
+push_timeout: 30m
+tag_rules:
+  - repository: "*/*"
+    pattern: "v*"
+    immutable: true
+retention:
+  rules:
+    - repository: "ci/*"
+      pattern: "*"
+      keep_last: 10
+quotas:
+  "*": 1000
+`)
+	defer os.Remove(filename)
+
+	config, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.ApplyEnv([]string{"CRANE_LISTEN=:7000", "CRANE_STORAGE_OPTION_DATADIR=/data", "OTHER=1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if config.Listen != ":7000" {
+		t.Errorf("Env did not override listen: %s", config.Listen)
+	}
+	if config.DriverOptions(config.Storage)["datadir"] != "/data" {
+		t.Errorf("Env did not override storage option: %v", config.Storage.Options)
+	}
+	if config.DriverOptions(config.Metadata)["datadir"] != config.DataDir {
+		t.Errorf("Driver datadir does not default to datadir: %v", config.DriverOptions(config.Metadata))
+	}
+	if config.PushTimeout != 30*time.Minute || config.Log.Level != "info" {
+		t.Errorf("Wrong push timeout or defaults: %+v", config)
+	}
+	if len(config.TagRules) != 1 || !config.TagRules[0].Immutable || config.Retention.Rules[0].KeepLast != 10 {
+		t.Errorf("Rules not loaded: %+v %+v", config.TagRules, config.Retention.Rules)
+	}
+	if config.Quotas.Quota("any") != 1000 || config.Endpoints[0] != "registry.example.com" {
+		t.Errorf("Quotas or endpoints not loaded")
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	filename := writeTestConfig(t, `
+storage:
+  driver: unknown
+tls:
+  cert: cert.pem
+log:
+  level: verbose
+`)
+	defer os.Remove(filename)
+
+	config, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = config.Validate()
+	if err == nil {
+		t.Fatal("Invalid config accepted")
+	}
+	for _, msg := range []string{"storage", "tls", "log"} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("Error does not report %s: %v", msg, err)
+		}
+	}
+
+	unknownKey := writeTestConfig(t, "lisen: \":5000\"\n")
+	defer os.Remove(unknownKey)
+	if _, err := LoadConfig(unknownKey); err == nil {
+		t.Error("Unknown key accepted")
+	}
+}
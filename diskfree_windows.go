@@ -0,0 +1,9 @@
+package main
+
+import (
+	"errors"
+)
+
+func diskFree(dir string) (int64, error) {
+	return 0, errors.New("Free disk space not supported on windows")
+}
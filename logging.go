@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+)
+
+// Headers which carry credentials or tokens and are never logged
+var redactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "X-Docker-Token", "Www-Authenticate"}
+
+const redacted = "[REDACTED]"
+
+type contextKey int
+
+const loggerKey contextKey = iota
+
+// Creates a logger writing to stderr with level debug, info, warn or error and format text or json
+func NewLogger(level string, format string) (*logrus.Logger, error) {
+	logger := logrus.New()
+	logger.Out = os.Stderr
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	logger.Level = lvl
+	switch format {
+	case "text":
+		logger.Formatter = &logrus.TextFormatter{FullTimestamp: true}
+	case "json":
+		logger.Formatter = &logrus.JSONFormatter{}
+	default:
+		return nil, errors.New("Unknown log format " + format)
+	}
+	return logger, nil
+}
+
+// Returns a copy of h with all credentials replaced
+func redactHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = v
+	}
+	for _, k := range redactedHeaders {
+		if _, found := c[k]; found {
+			c[k] = []string{redacted}
+		}
+	}
+	return c
+}
+
+// Uses the X-Request-Id of the client or creates a new one
+func requestID(req *http.Request) string {
+	if id := req.Header.Get("X-Request-Id"); id != "" && len(id) <= 64 {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func withLogger(req *http.Request, logger logrus.FieldLogger) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), loggerKey, logger))
+}
+
+// Returns the logger of the request, tagged with its request id
+func (r *RegistryAPI) logger(req *http.Request) logrus.FieldLogger {
+	if logger, ok := req.Context().Value(loggerKey).(logrus.FieldLogger); ok {
+		return logger
+	}
+	return r.log
+}
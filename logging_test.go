@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLoggingRedactsCredentials(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	logger, err := NewLogger("debug", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	logger.Out = &buf
+	api := NewRegistryAPI(r, logger)
+
+	req := httptest.NewRequest("GET", "/v1/users/", nil)
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:secretpass")))
+	req.Header.Set("X-Request-Id", "req-1")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	out := buf.String()
+	if strings.Contains(out, "secretpass") || strings.Contains(out, base64.StdEncoding.EncodeToString([]byte("user:secretpass"))) {
+		t.Errorf("Credentials logged: %s", out)
+	}
+	if !strings.Contains(out, "\"request_id\":\"req-1\"") {
+		t.Errorf("Request id not logged: %s", out)
+	}
+	if w.Header().Get("X-Request-Id") != "req-1" {
+		t.Errorf("Request id not returned")
+	}
+}
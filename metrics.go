@@ -0,0 +1,259 @@
+package main
+
+import (
+	"github.com/blang/crane/store"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics collects prometheus metrics of the registry api and its store
+type Metrics struct {
+	registerer         prometheus.Registerer
+	requests           *prometheus.CounterVec
+	durations          *prometheus.HistogramVec
+	authFailures       *prometheus.CounterVec
+	checksumMismatches prometheus.CounterFunc // set by InstrumentRegistry
+	bytesUploaded      prometheus.Counter
+	bytesDownloaded    prometheus.Counter
+	activeUploads      prometheus.Gauge
+}
+
+func NewMetrics(registerer prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		registerer: registerer,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "crane",
+			Name:      "http_requests_total",
+			Help:      "Number of http requests by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "crane",
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of http requests by route and method.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"route", "method"}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "crane",
+			Name:      "auth_failures_total",
+			Help:      "Number of requests denied with 401 by route.",
+		}, []string{"route"}),
+		bytesUploaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "crane",
+			Name:      "layer_uploaded_bytes_total",
+			Help:      "Bytes of layers uploaded.",
+		}),
+		bytesDownloaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "crane",
+			Name:      "layer_downloaded_bytes_total",
+			Help:      "Bytes of layers downloaded.",
+		}),
+		activeUploads: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "crane",
+			Name:      "active_uploads",
+			Help:      "Number of layer uploads in progress.",
+		}),
+	}
+	registerer.MustRegister(m.requests, m.durations, m.authFailures,
+		m.bytesUploaded, m.bytesDownloaded, m.activeUploads)
+	return m
+}
+
+// Wraps the api to count requests and measure their latency per route
+func (m *Metrics) InstrumentAPI(api *RegistryAPI) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route := "unmatched"
+		var match mux.RouteMatch
+		if api.router.Match(req, &match) && match.Route != nil {
+			if tpl, err := match.Route.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		sw := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		api.ServeHTTP(sw, req)
+
+		m.durations.WithLabelValues(route, req.Method).Observe(time.Since(start).Seconds())
+		m.requests.WithLabelValues(route, req.Method, strconv.Itoa(sw.status)).Inc()
+		if sw.status == http.StatusUnauthorized {
+			m.authFailures.WithLabelValues(route).Inc()
+		}
+	})
+}
+
+// Wraps the store to count layer bytes and uploads in progress, and exports the storage usage.
+// The usage is counted once here and kept up to date on commits and deletions.
+func (m *Metrics) InstrumentStore(s store.Store) store.Store {
+	instrumented := &instrumentedStore{
+		Store:   s,
+		metrics: m,
+	}
+	for _, imageID := range s.ImageIDs() {
+		size, _ := s.Size(imageID)
+		instrumented.images++
+		instrumented.bytes += size
+	}
+	m.registerer.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "crane",
+		Name:      "storage_images",
+		Help:      "Number of committed images.",
+	}, func() float64 {
+		return float64(atomic.LoadInt64(&instrumented.images))
+	}))
+	m.registerer.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "crane",
+		Name:      "storage_bytes",
+		Help:      "Bytes of committed layers.",
+	}, func() float64 {
+		return float64(atomic.LoadInt64(&instrumented.bytes))
+	}))
+	return instrumented
+}
+
+// Exports the hit, miss and eviction counters and the size of cache
+func (m *Metrics) InstrumentCache(cache *store.Cache) {
+	counters := map[string]func(store.CacheStats) uint64{
+		"hits":      func(s store.CacheStats) uint64 { return s.Hits },
+		"misses":    func(s store.CacheStats) uint64 { return s.Misses },
+		"evictions": func(s store.CacheStats) uint64 { return s.Evictions },
+	}
+	for name, counter := range counters {
+		counter := counter
+		m.registerer.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "crane",
+			Name:      "cache_" + name + "_total",
+			Help:      "Number of cache " + name + ".",
+		}, func() float64 {
+			return float64(counter(cache.Stats()))
+		}))
+	}
+	m.registerer.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "crane",
+		Name:      "cache_bytes",
+		Help:      "Bytes of cached layers and image json.",
+	}, func() float64 {
+		return float64(cache.Stats().Bytes)
+	}))
+}
+
+// Exports the uploads rejected by the registry by reason and its checksum mismatches
+func (m *Metrics) InstrumentRegistry(registry *Registry) {
+	m.checksumMismatches = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "crane",
+		Name:      "checksum_mismatches_total",
+		Help:      "Number of layers rejected because of a checksum mismatch.",
+	}, func() float64 {
+		return float64(registry.ChecksumMismatches())
+	})
+	m.registerer.MustRegister(m.checksumMismatches)
+	for _, reason := range rejectReasons {
+		reason := reason
+		m.registerer.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "crane",
+			Name:        "rejected_uploads_total",
+			Help:        "Number of layer uploads rejected by reason.",
+			ConstLabels: prometheus.Labels{"reason": reason},
+		}, func() float64 {
+			return float64(registry.RejectedUploads()[reason])
+		}))
+	}
+}
+
+type instrumentedStore struct {
+	store.Store
+	metrics *Metrics
+	images  int64 // committed images, updated atomically
+	bytes   int64 // bytes of committed layers, updated atomically
+}
+
+func (s *instrumentedStore) CommitTmpImage(imageID string) bool {
+	oldSize, replaced := s.Store.Size(imageID)
+	if !s.Store.CommitTmpImage(imageID) {
+		return false
+	}
+	size, _ := s.Store.Size(imageID)
+	if !replaced {
+		atomic.AddInt64(&s.images, 1)
+	}
+	atomic.AddInt64(&s.bytes, size-oldSize)
+	return true
+}
+
+func (s *instrumentedStore) DeleteImage(imageID string) bool {
+	size, _ := s.Store.Size(imageID)
+	if !s.Store.DeleteImage(imageID) {
+		return false
+	}
+	atomic.AddInt64(&s.images, -1)
+	atomic.AddInt64(&s.bytes, -size)
+	return true
+}
+
+func (s *instrumentedStore) SetTmpLayer(imageID string, imageJSON string, r io.ReadCloser) (string, int64, error) {
+	s.metrics.activeUploads.Inc()
+	defer s.metrics.activeUploads.Dec()
+	checksum, size, err := s.Store.SetTmpLayer(imageID, imageJSON, r)
+	s.metrics.bytesUploaded.Add(float64(size))
+	return checksum, size, err
+}
+
+func (s *instrumentedStore) Flush() error {
+	return store.Flush(s.Store)
+}
+
+func (s *instrumentedStore) Persistent() bool {
+	return store.IsPersistent(s.Store)
+}
+
+func (s *instrumentedStore) LayerIDs() ([]string, error) {
+	return store.LayerIDs(s.Store)
+}
+
+func (s *instrumentedStore) QuarantineLayer(imageID string) error {
+	return store.QuarantineLayer(s.Store, imageID)
+}
+
+func (s *instrumentedStore) Layer(imageID string) (store.ReadCloseSeeker, error) {
+	layer, err := s.Store.Layer(imageID)
+	if err != nil {
+		return nil, err
+	}
+	return &countingReadCloseSeeker{ReadCloseSeeker: layer, counter: s.metrics.bytesDownloaded}, nil
+}
+
+// Layers read bypassing caches, e.g. by the scrubber, are not counted as downloaded
+func (s *instrumentedStore) UncachedLayer(imageID string) (store.ReadCloseSeeker, error) {
+	return store.UncachedLayer(s.Store, imageID)
+}
+
+type countingReadCloseSeeker struct {
+	store.ReadCloseSeeker
+	counter prometheus.Counter
+}
+
+func (c *countingReadCloseSeeker) Read(p []byte) (int, error) {
+	n, err := c.ReadCloseSeeker.Read(p)
+	c.counter.Add(float64(n))
+	return n, err
+}
+
+// Records the status code written by a handler
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/blang/crane/auth"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsAPI(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	m := NewMetrics(prometheus.NewRegistry())
+	m.InstrumentRegistry(r)
+	handler := m.InstrumentAPI(NewRegistryAPI(r, newTestLogger()))
+
+	for _, path := range []string{"/v1/_ping", "/v1/images/123/layer", "/v1/images/456/layer"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if c := testutil.ToFloat64(m.requests.WithLabelValues("/v1/_ping", "GET", "200")); c != 1 {
+		t.Errorf("Expected 1 ping request, got %f", c)
+	}
+	if c := testutil.ToFloat64(m.authFailures.WithLabelValues("/v1/images/{image_id}/layer")); c != 2 {
+		t.Errorf("Expected 2 auth failures, got %f", c)
+	}
+
+	writeToken, _ := r.Authenticator().Authorize("user", "pass", "user", "repo", []string{"123"}, auth.O_WRONLY)
+	putChecksum := func() int {
+		req := httptest.NewRequest("PUT", "/v1/images/123/checksum", nil)
+		req.Header.Set("Authorization", "Token Token signature="+writeToken+",repository=\"user/repo\",access=write")
+		req.Header.Set("X-Docker-Checksum-Payload", "sha256:invalid")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	// Without an uploaded layer there is nothing to mismatch
+	if code := putChecksum(); code != http.StatusConflict || testutil.ToFloat64(m.checksumMismatches) != 0 {
+		t.Errorf("Missing layer counted as checksum mismatch, status %d", code)
+	}
+	r.SetTmpImageJSON("123", "{}")
+	if err := r.SetTmpLayer(writeToken, "123", "{}", ioutil.NopCloser(strings.NewReader("layer"))); err != nil {
+		t.Fatal(err)
+	}
+	if code := putChecksum(); code != http.StatusConflict || testutil.ToFloat64(m.checksumMismatches) != 1 {
+		t.Errorf("Checksum mismatch not counted, status %d", code)
+	}
+}
+
+func TestMetricsStore(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	m := NewMetrics(prometheus.NewRegistry())
+	r.store = m.InstrumentStore(r.store)
+
+	pushTestImage(t, r, "", "img1")
+	layer, err := r.Layer("img1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, _ := layer.Read(buf)
+	layer.Close()
+	if up := testutil.ToFloat64(m.bytesUploaded); up != 13 {
+		t.Errorf("Expected 13 bytes uploaded, got %f", up)
+	}
+	if down := testutil.ToFloat64(m.bytesDownloaded); down != float64(n) {
+		t.Errorf("Expected %d bytes downloaded, got %f", n, down)
+	}
+
+	pushTestImage(t, r, "", "img2")
+	r.store.DeleteImage("img1")
+	instrumented := r.store.(*instrumentedStore)
+	if instrumented.images != 1 || instrumented.bytes != 13 {
+		t.Errorf("Wrong storage usage: %d images, %d bytes", instrumented.images, instrumented.bytes)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/blang/crane/store"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	ErrMigrationSource  = errors.New("Image incomplete in source store")
+	ErrChecksumMismatch = errors.New("Checksum mismatch")
+	ErrMigrationCommit  = errors.New("Could not commit image in destination store")
+	ErrMissingMetadata  = errors.New("Source store has layers without metadata")
+)
+
+type MigrationReport struct {
+	Images       int // copied images
+	Skipped      int // images already present in the destination
+	Repositories int
+}
+
+// Copies all committed images with their layers and all repositories from src to dst.
+// Every copied layer is read back and verified against the source checksum.
+// Verified images in dst are skipped, so an interrupted migration can simply be run again.
+// Fails with ErrMissingMetadata before copying anything if src has layers of unknown images.
+func Migrate(src, dst store.Store, log logrus.FieldLogger) (MigrationReport, error) {
+	var report MigrationReport
+	if err := checkSourceMetadata(src); err != nil {
+		return report, err
+	}
+	done := make(map[string]bool)
+	for _, imageID := range src.ImageIDs() {
+		ancestry, err := src.Ancestry(imageID)
+		if err != nil {
+			return report, fmt.Errorf("image %s: %v", imageID, err)
+		}
+		// Parents first, so the ancestry in dst is never dangling
+		for i := len(ancestry) - 1; i >= 0; i-- {
+			id := ancestry[i]
+			if done[id] {
+				continue
+			}
+			done[id] = true
+			copied, err := migrateImage(src, dst, id)
+			if err != nil {
+				return report, fmt.Errorf("image %s: %v", id, err)
+			}
+			if copied {
+				log.WithField("image", id).Debug("Image migrated")
+				report.Images++
+			} else {
+				report.Skipped++
+			}
+		}
+	}
+	for _, name := range src.Repositories() {
+		parts := strings.SplitN(name, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if err := migrateRepository(src, dst, parts[0], parts[1]); err != nil {
+			return report, fmt.Errorf("repository %s: %v", name, err)
+		}
+		report.Repositories++
+	}
+	return report, store.Flush(dst)
+}
+
+// Checks that every layer of src has metadata, so no layer is left behind silently
+func checkSourceMetadata(src store.Store) error {
+	layerIDs, err := store.LayerIDs(src)
+	if err == store.ErrListUnsupported {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	missing := 0
+	for _, imageID := range layerIDs {
+		if _, found := src.ImageJSON(imageID); !found {
+			missing++
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("%v: %d of %d layers", ErrMissingMetadata, missing, len(layerIDs))
+	}
+	return nil
+}
+
+// Copies an image unless it is already present and valid in dst
+func migrateImage(src, dst store.Store, imageID string) (bool, error) {
+	imageJSON, found1 := src.ImageJSON(imageID)
+	checksum, found2 := src.Checksum(imageID)
+	if !(found1 && found2) {
+		return false, ErrMigrationSource
+	}
+	if _, found := dst.ImageJSON(imageID); found {
+		if dstChecksum, err := layerChecksum(dst, imageID, imageJSON); err == nil && dstChecksum == checksum {
+			return false, nil
+		}
+	}
+
+	layer, err := src.Layer(imageID)
+	if err != nil {
+		return false, err
+	}
+	_, size, err := dst.SetTmpLayer(imageID, imageJSON, layer)
+	if err != nil {
+		dst.DiscardTmpLayer(imageID)
+		return false, err
+	}
+	ancestry, err := src.Ancestry(imageID)
+	if err != nil {
+		dst.DiscardTmpLayer(imageID)
+		return false, err
+	}
+	dst.SetTmpImageJSON(imageID, imageJSON)
+	dst.SetTmpChecksum(imageID, checksum)
+	dst.SetTmpSize(imageID, size)
+	// Keeps Last-Modified of the image
+	if committed, found := src.Committed(imageID); found {
+		dst.SetTmpCommitted(imageID, committed)
+	}
+	if len(ancestry) > 1 {
+		dst.SetTmpAncestry(imageID, ancestry[1])
+	}
+	if !dst.CommitTmpLayer(imageID) || !dst.CommitTmpImage(imageID) {
+		dst.DiscardTmpImage(imageID)
+		dst.DiscardTmpLayer(imageID)
+		return false, ErrMigrationCommit
+	}
+
+	dstChecksum, err := layerChecksum(dst, imageID, imageJSON)
+	if err != nil {
+		return false, err
+	}
+	if dstChecksum != checksum {
+		dst.DeleteImage(imageID)
+		dst.DeleteLayer(imageID)
+		return false, ErrChecksumMismatch
+	}
+	return true, nil
+}
+
+// Copies images, tags and missing tag history of a repository
+func migrateRepository(src, dst store.Store, namespace, repository string) error {
+	images, err := src.Images(namespace, repository)
+	if err != nil {
+		return err
+	}
+	if err := dst.SetImages(namespace, repository, images); err != nil {
+		return err
+	}
+	tags, _ := src.Tags(namespace, repository)
+	for tag, imageID := range tags {
+		if err := dst.SetTag(namespace, repository, imageID, tag); err != nil {
+			return err
+		}
+	}
+	for tag := range tags {
+		history, _ := src.TagHistory(namespace, repository, tag)
+		dstHistory, _ := dst.TagHistory(namespace, repository, tag)
+		for i := len(dstHistory); i < len(history); i++ {
+			if err := dst.AddTagHistory(namespace, repository, tag, history[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Calculates the checksum of a committed layer like SetTmpLayer does, reading the data at rest past any cache
+func layerChecksum(s store.Store, imageID string, imageJSON string) (string, error) {
+	layer, err := store.UncachedLayer(s, imageID)
+	if err != nil {
+		return "", err
+	}
+	defer layer.Close()
+	hash := sha256.New()
+	hash.Write([]byte(imageJSON + "\n"))
+	if _, err := io.Copy(hash, layer); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Runs crane migrate -from <config> -to <config>, the server must not be running.
+// Both metadata drivers must be persistent, like the file driver, otherwise there is nothing to migrate
+// or the result is lost. CRANE_* environment overrides apply to both configs.
+func migrateCommand(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := flags.String("from", "", "Config file of the source store")
+	to := flags.String("to", "", "Config file of the destination store")
+	flags.Parse(args)
+	if *from == "" || *to == "" {
+		fmt.Fprintln(os.Stderr, "Usage: crane migrate -from <config> -to <config>")
+		return 2
+	}
+
+	var stores []store.Store
+	var log logrus.FieldLogger
+	for _, filename := range []string{*from, *to} {
+		config, err := LoadConfig(filename)
+		if err == nil {
+			err = config.ApplyEnv(os.Environ())
+		}
+		if err == nil {
+			err = config.Validate()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if log == nil {
+			if log, err = NewLogger(config.Log.Level, config.Log.Format); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 2
+			}
+		}
+		metaStorage, fileStorage, err := buildStorage(config, log)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+			return 1
+		}
+		if !store.IsPersistent(metaStorage) {
+			fmt.Fprintf(os.Stderr, "%s: metadata driver %s is not persistent, refusing to migrate\n", filename, config.Metadata.Driver)
+			return 2
+		}
+		stores = append(stores, store.NewProxyStore(metaStorage, fileStorage))
+	}
+
+	report, err := Migrate(stores[0], stores[1], log)
+	entry := log.WithFields(logrus.Fields{"images": report.Images, "skipped": report.Skipped, "repositories": report.Repositories})
+	if err != nil {
+		entry.Errorf("Migration failed, run again to resume: %v", err)
+		return 1
+	}
+	entry.Info("Migration complete")
+	return 0
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"github.com/blang/crane/auth"
+	"github.com/blang/crane/store"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	r.BeginPush("token", "user", "user", "repo", []string{"img1", "img2"})
+	pushTestImage(t, r, "token", "img1")
+	r.SetTmpAncestry("img2", "img1")
+	pushTestImage(t, r, "token", "img2")
+	r.PushTag("token", "user", "repo", "img2", "latest")
+	if err := r.FinishPush("user", "user", "repo"); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := store.NewProxyStore(store.NewMemMetaStorage(), store.NewMemFileStorage())
+	report, err := Migrate(r.store, dst, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Images != 2 || report.Repositories != 1 {
+		t.Errorf("Wrong report: %+v", report)
+	}
+	if imageID, _ := dst.Tag("user", "repo", "latest"); imageID != "img2" {
+		t.Errorf("Tag not migrated: %s", imageID)
+	}
+	if ancestry, _ := dst.Ancestry("img2"); len(ancestry) != 2 || ancestry[1] != "img1" {
+		t.Errorf("Ancestry not migrated: %v", ancestry)
+	}
+	if size, _ := dst.Size("img1"); size != 13 {
+		t.Errorf("Wrong size: %d", size)
+	}
+	srcCommitted, _ := r.Committed("img1")
+	if committed, _ := dst.Committed("img1"); !committed.Equal(srcCommitted) {
+		t.Errorf("Commit time changed from %v to %v", srcCommitted, committed)
+	}
+
+	// Resuming skips migrated images and does not duplicate history
+	dst.DeleteLayer("img1")
+	report, err = Migrate(r.store, dst, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Images != 1 || report.Skipped != 1 {
+		t.Errorf("Resume did not skip migrated images: %+v", report)
+	}
+	if history, _ := dst.TagHistory("user", "repo", "latest"); len(history) != 1 {
+		t.Errorf("Tag history duplicated: %v", history)
+	}
+}
+
+func TestMigrateChecksumMismatch(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	pushTestImage(t, r, "token", "img1")
+	r.store.SetTmpImageJSON("img1", "{}")
+	r.store.SetTmpChecksum("img1", "corrupt")
+	r.store.SetTmpSize("img1", 13)
+	r.store.CommitTmpImage("img1")
+
+	dst := store.NewProxyStore(store.NewMemMetaStorage(), store.NewMemFileStorage())
+	if _, err := Migrate(r.store, dst, newTestLogger()); err == nil {
+		t.Fatal("Corrupt image migrated")
+	}
+	if _, found := dst.ImageJSON("img1"); found {
+		t.Error("Corrupt image left in destination")
+	}
+}
+
+func TestMigrateMissingMetadata(t *testing.T) {
+	files := store.NewMemFileStorage()
+	src := store.NewProxyStore(store.NewMemMetaStorage(), files)
+	files.SetTmpLayer("img1", "{}", ioutil.NopCloser(strings.NewReader("layer")))
+	files.CommitTmpLayer("img1")
+
+	dst := store.NewProxyStore(store.NewMemMetaStorage(), store.NewMemFileStorage())
+	if _, err := Migrate(src, dst, newTestLogger()); err == nil || !strings.Contains(err.Error(), ErrMissingMetadata.Error()) {
+		t.Errorf("Migration of layers without metadata succeeded: %v", err)
+	}
+}
+
+// Writes a config using the file metadata driver with its data below a new tmp directory
+func writeFileStoreConfig(t *testing.T) (string, func()) {
+	dataDir, err := ioutil.TempDir("", "crane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := path.Join(dataDir, "config.yml")
+	config := "datadir: " + path.Join(dataDir, "data") + "\nmetadata:\n  driver: file\n"
+	if err := ioutil.WriteFile(filename, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename, func() { os.RemoveAll(dataDir) }
+}
+
+// Opens the store of the config written by writeFileStoreConfig
+func openConfigStore(t *testing.T, filename string) store.Store {
+	config, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaStorage, fileStorage, err := buildStorage(config, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.NewProxyStore(metaStorage, fileStorage)
+}
+
+func TestMigrateCommand(t *testing.T) {
+	from, cleanupFrom := writeFileStoreConfig(t)
+	defer cleanupFrom()
+	to, cleanupTo := writeFileStoreConfig(t)
+	defer cleanupTo()
+
+	r := NewRegistry(openConfigStore(t, from), auth.NewLocalAuthenticator(), newTestLogger())
+	pushTestImage(t, r, "", "img1")
+	r.SetImages("user", "repo", []string{"img1"})
+	r.SetTag("user", "user", "repo", "img1", "latest")
+
+	if code := migrateCommand([]string{"-from", from, "-to", to}); code != 0 {
+		t.Fatalf("Migration failed with %d", code)
+	}
+	dst := openConfigStore(t, to)
+	if imageID, _ := dst.Tag("user", "repo", "latest"); imageID != "img1" {
+		t.Errorf("Tag not migrated: %q", imageID)
+	}
+	if _, err := dst.Layer("img1"); err != nil {
+		t.Errorf("Layer not migrated: %v", err)
+	}
+}
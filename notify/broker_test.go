@@ -0,0 +1,32 @@
+package notify
+
+import (
+	"testing"
+)
+
+func TestBroker(t *testing.T) {
+	b := NewBroker()
+	ch1, cancel1 := b.Subscribe(1)
+	ch2, cancel2 := b.Subscribe(1)
+	defer cancel2()
+
+	b.Notify(NewEvent(EventTagSet, "user", "user", "repo", "img1", "latest"))
+	if e := <-ch1; e.Tag != "latest" {
+		t.Errorf("Wrong event: %+v", e)
+	}
+	cancel1()
+	if _, open := <-ch1; open {
+		t.Error("Channel still open after cancel")
+	}
+
+	// Buffer of ch2 is full, event is dropped instead of blocking
+	b.Notify(NewEvent(EventTagSet, "user", "user", "repo", "img2", "latest"))
+	if e := <-ch2; e.ImageID != "img1" {
+		t.Errorf("Wrong event: %+v", e)
+	}
+	select {
+	case e := <-ch2:
+		t.Errorf("Dropped event received: %+v", e)
+	default:
+	}
+}
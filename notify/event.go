@@ -0,0 +1,49 @@
+package notify
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	EventImageCommitted    = "image.committed"
+	EventTagSet            = "tag.set"
+	EventRepositoryDeleted = "repository.deleted"
+)
+
+// Event describes a change in the registry
+type Event struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	User       string    `json:"user,omitempty"`
+	Namespace  string    `json:"namespace,omitempty"`
+	Repository string    `json:"repository,omitempty"`
+	ImageID    string    `json:"image,omitempty"`
+	Tag        string    `json:"tag,omitempty"`
+}
+
+func NewEvent(eventType string, user, namespace, repository, imageID, tag string) Event {
+	return Event{
+		ID:         randomID(),
+		Type:       eventType,
+		Time:       time.Now(),
+		User:       user,
+		Namespace:  namespace,
+		Repository: repository,
+		ImageID:    imageID,
+		Tag:        tag,
+	}
+}
+
+// Sink receives registry events, Notify must not block
+type Sink interface {
+	Notify(event Event)
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
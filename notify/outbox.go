@@ -0,0 +1,183 @@
+package notify
+
+import (
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delivery of an event to a webhook endpoint
+type Delivery struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	Event       Event     `json:"event"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Encrypts delivery files, e.g. a store.RecordCipher
+type Cipher interface {
+	Seal(record []byte) ([]byte, error)
+	Open(sealed []byte) ([]byte, error)
+}
+
+// Outbox persists deliveries as json files so they survive restarts.
+// Pending deliveries are kept in dir/pending, deliveries which ran out of retries in dir/failed.
+// Files which can not be read, e.g. sealed with a removed key, are moved to dir/invalid.
+// Files are sealed with the cipher if one is set.
+type Outbox struct {
+	dir    string
+	cipher Cipher
+	mu     sync.Mutex
+	log    logrus.FieldLogger
+}
+
+// Creates an outbox in dir, cipher may be nil to store deliveries unencrypted
+func NewOutbox(dir string, cipher Cipher, logger logrus.FieldLogger) (*Outbox, error) {
+	for _, sub := range []string{"pending", "failed", "invalid"} {
+		if err := os.MkdirAll(path.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Outbox{
+		dir:    dir,
+		cipher: cipher,
+		log:    logger,
+	}, nil
+}
+
+// Stores or updates a pending delivery
+func (o *Outbox) Put(d *Delivery) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.write("pending", d)
+}
+
+// Removes a delivered delivery
+func (o *Outbox) Done(d *Delivery) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return os.Remove(path.Join(o.dir, "pending", d.ID+".json"))
+}
+
+// Moves a delivery to the failed deliveries
+func (o *Outbox) Fail(d *Delivery) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.write("failed", d); err != nil {
+		return err
+	}
+	return os.Remove(path.Join(o.dir, "pending", d.ID+".json"))
+}
+
+func (o *Outbox) Pending() ([]*Delivery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.read("pending")
+}
+
+func (o *Outbox) Failed() ([]*Delivery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.read("failed")
+}
+
+// Writes atomically by renaming a synced tmp file
+func (o *Outbox) write(sub string, d *Delivery) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if o.cipher != nil {
+		if b, err = o.cipher.Seal(b); err != nil {
+			return err
+		}
+	}
+	filename := path.Join(o.dir, sub, d.ID+".json")
+	f, err := os.OpenFile(filename+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(filename+".tmp", filename)
+	}
+	if err != nil {
+		os.Remove(filename + ".tmp")
+		return err
+	}
+	return syncDir(path.Join(o.dir, sub))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Reads all deliveries of sub ordered by event time, unreadable files are moved to dir/invalid
+func (o *Outbox) read(sub string) ([]*Delivery, error) {
+	files, err := ioutil.ReadDir(path.Join(o.dir, sub))
+	if err != nil {
+		return nil, err
+	}
+	var deliveries []*Delivery
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		d, err := o.readFile(path.Join(o.dir, sub, file.Name()))
+		if err != nil {
+			o.invalidate(sub, file.Name(), err)
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].Event.Time.Before(deliveries[j].Event.Time)
+	})
+	return deliveries, nil
+}
+
+func (o *Outbox) readFile(filename string) (*Delivery, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if o.cipher != nil {
+		if b, err = o.cipher.Open(b); err != nil {
+			return nil, err
+		}
+	}
+	var d Delivery
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Moves an unreadable file aside, so it does not hold up the other deliveries but can still be recovered
+func (o *Outbox) invalidate(sub string, name string, reason error) {
+	entry := o.log.WithField("file", path.Join(sub, name))
+	if err := os.Rename(path.Join(o.dir, sub, name), path.Join(o.dir, "invalid", sub+"-"+name)); err != nil {
+		entry.Errorf("Webhook: Could not move unreadable delivery aside: %v", err)
+		return
+	}
+	entry.Errorf("Webhook: Moved unreadable delivery aside: %v", reason)
+}
@@ -0,0 +1,265 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Endpoint receives events as json via http POST.
+// If Secret is set, the body is signed with HMAC-SHA256 in the X-Crane-Signature header.
+type Endpoint struct {
+	URL    string   `json:"url" yaml:"url"`
+	Secret string   `json:"secret" yaml:"secret"`
+	Events []string `json:"events" yaml:"events"` // Event types to send, empty sends all
+}
+
+func (e Endpoint) wants(eventType string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, t := range e.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks urls and event types of endpoints
+func ValidateEndpoints(endpoints []Endpoint) error {
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint.URL)
+		if err != nil || !(u.Scheme == "http" || u.Scheme == "https") || u.Host == "" {
+			return errors.New("Invalid webhook url " + endpoint.URL)
+		}
+		for _, eventType := range endpoint.Events {
+			switch eventType {
+			case EventImageCommitted, EventTagSet, EventRepositoryDeleted:
+			default:
+				return errors.New("Unknown webhook event " + eventType)
+			}
+		}
+	}
+	return nil
+}
+
+// Signs body with secret, returns the value of the X-Crane-Signature header
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookNotifier delivers events to endpoints through a persistent outbox.
+// Failed deliveries are retried with exponential backoff until MaxAttempts is reached.
+type WebhookNotifier struct {
+	endpoints   map[string]Endpoint // url -> endpoint
+	outbox      *Outbox
+	mu          sync.Mutex
+	queue       []Event    // events not written to the outbox yet
+	persistMu   sync.Mutex // held while queued events are written
+	started     bool
+	client      *http.Client
+	MaxAttempts int
+	Backoff     time.Duration // Delay after first failure, doubled on each further failure
+	MaxBackoff  time.Duration
+	wake        chan struct{}
+	stop        chan struct{}
+	done        chan struct{}
+	log         logrus.FieldLogger
+}
+
+func NewWebhookNotifier(endpoints []Endpoint, outbox *Outbox, logger logrus.FieldLogger) *WebhookNotifier {
+	emap := make(map[string]Endpoint)
+	for _, endpoint := range endpoints {
+		emap[endpoint.URL] = endpoint
+	}
+	return &WebhookNotifier{
+		endpoints:   emap,
+		outbox:      outbox,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts: 10,
+		Backoff:     time.Second,
+		MaxBackoff:  10 * time.Minute,
+		wake:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		log:         logger,
+	}
+}
+
+// Queues the event for all endpoints subscribed to its type.
+// The deliveries are written to the outbox by the delivery goroutine or Sync, so Notify does not block on disk writes.
+func (n *WebhookNotifier) Notify(event Event) {
+	n.mu.Lock()
+	n.queue = append(n.queue, event)
+	n.mu.Unlock()
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Writes the queued events to the outbox, events queued before the call survive a restart once it returns
+func (n *WebhookNotifier) Sync() {
+	n.persistQueued()
+}
+
+// Writes a delivery of each queued event to the outbox for all endpoints subscribed to its type
+func (n *WebhookNotifier) persistQueued() {
+	// A concurrent call may have taken events queued before this call, wait until they are written
+	n.persistMu.Lock()
+	defer n.persistMu.Unlock()
+	n.mu.Lock()
+	events := n.queue
+	n.queue = nil
+	n.mu.Unlock()
+	for _, event := range events {
+		for _, endpoint := range n.endpoints {
+			if !endpoint.wants(event.Type) {
+				continue
+			}
+			d := &Delivery{
+				ID:          randomID(),
+				URL:         endpoint.URL,
+				Event:       event,
+				NextAttempt: time.Now(),
+			}
+			if err := n.outbox.Put(d); err != nil {
+				n.log.WithFields(logrus.Fields{"event": event.ID, "url": endpoint.URL}).Errorf("Webhook: Could not queue event: %v", err)
+			}
+		}
+	}
+}
+
+// Deliveries which ran out of retries
+func (n *WebhookNotifier) Failures() ([]*Delivery, error) {
+	return n.outbox.Failed()
+}
+
+// Starts delivering in the background, including deliveries left over from a previous run
+func (n *WebhookNotifier) Start() {
+	n.started = true
+	go n.run()
+}
+
+// Stops delivering, queued events are written to the outbox and pending deliveries stay there
+func (n *WebhookNotifier) Stop() {
+	close(n.stop)
+	if n.started {
+		<-n.done
+	}
+	n.persistQueued()
+}
+
+func (n *WebhookNotifier) run() {
+	defer close(n.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		n.deliverPending()
+		select {
+		case <-n.stop:
+			return
+		case <-n.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (n *WebhookNotifier) deliverPending() {
+	n.persistQueued()
+	deliveries, err := n.outbox.Pending()
+	if err != nil {
+		n.log.Errorf("Webhook: Could not read outbox: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, d := range deliveries {
+		if d.NextAttempt.After(now) {
+			continue
+		}
+		select {
+		case <-n.stop:
+			return
+		default:
+		}
+		n.attempt(d)
+		// Slow endpoints must not keep new events from being persisted
+		n.persistQueued()
+	}
+}
+
+func (n *WebhookNotifier) attempt(d *Delivery) {
+	d.Attempts++
+	err := n.deliver(d)
+	if err == nil {
+		if err := n.outbox.Done(d); err != nil {
+			n.log.WithField("delivery", d.ID).Errorf("Webhook: Could not remove delivery: %v", err)
+		}
+		return
+	}
+	d.LastError = err.Error()
+	n.log.WithFields(logrus.Fields{"event": d.Event.ID, "url": d.URL, "attempt": d.Attempts}).Warnf("Webhook: Delivery failed: %v", err)
+	if d.Attempts >= n.MaxAttempts {
+		if err := n.outbox.Fail(d); err != nil {
+			n.log.WithField("delivery", d.ID).Errorf("Webhook: Could not store failed delivery: %v", err)
+		}
+		return
+	}
+	d.NextAttempt = time.Now().Add(n.backoff(d.Attempts))
+	if err := n.outbox.Put(d); err != nil {
+		n.log.WithField("delivery", d.ID).Errorf("Webhook: Could not update delivery: %v", err)
+	}
+}
+
+func (n *WebhookNotifier) backoff(attempts int) time.Duration {
+	backoff := n.Backoff
+	for i := 1; i < attempts && backoff < n.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > n.MaxBackoff {
+		backoff = n.MaxBackoff
+	}
+	return backoff
+}
+
+func (n *WebhookNotifier) deliver(d *Delivery) error {
+	endpoint, found := n.endpoints[d.URL]
+	if !found {
+		return errors.New("Endpoint not configured")
+	}
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Crane-Event", d.Event.Type)
+	req.Header.Set("X-Crane-Delivery", d.ID)
+	if endpoint.Secret != "" {
+		req.Header.Set("X-Crane-Signature", Sign(endpoint.Secret, body))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+type receiver struct {
+	mu       sync.Mutex
+	fail     int // number of requests to fail
+	events   []Event
+	received chan struct{}
+}
+
+func newReceiver(fail int) (*receiver, *httptest.Server) {
+	rec := &receiver{fail: fail, received: make(chan struct{}, 10)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		if req.Header.Get("X-Crane-Signature") != Sign("secret", body) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if rec.fail > 0 {
+			rec.fail--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var event Event
+		json.Unmarshal(body, &event)
+		rec.events = append(rec.events, event)
+		rec.received <- struct{}{}
+	}))
+	return rec, server
+}
+
+func newTestLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return logger
+}
+
+func newTestOutbox(t *testing.T) (*Outbox, func()) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox, err := NewOutbox(dir, nil, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return outbox, func() { os.RemoveAll(dir) }
+}
+
+func waitReceived(t *testing.T, rec *receiver) {
+	select {
+	case <-rec.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event not delivered")
+	}
+}
+
+func TestWebhookDeliveryWithRetry(t *testing.T) {
+	rec, server := newReceiver(2)
+	defer server.Close()
+	outbox, cleanup := newTestOutbox(t)
+	defer cleanup()
+
+	n := NewWebhookNotifier([]Endpoint{{URL: server.URL, Secret: "secret", Events: []string{EventTagSet}}}, outbox, newTestLogger())
+	n.Backoff = time.Millisecond
+	n.Start()
+	defer n.Stop()
+
+	n.Notify(NewEvent(EventImageCommitted, "user", "user", "repo", "img1", ""))
+	n.Notify(NewEvent(EventTagSet, "user", "user", "repo", "img1", "latest"))
+	waitReceived(t, rec)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.events) != 1 || rec.events[0].Tag != "latest" {
+		t.Errorf("Expected only tag event, got %+v", rec.events)
+	}
+}
+
+func TestWebhookFailures(t *testing.T) {
+	_, server := newReceiver(100)
+	defer server.Close()
+	outbox, cleanup := newTestOutbox(t)
+	defer cleanup()
+
+	n := NewWebhookNotifier([]Endpoint{{URL: server.URL, Secret: "secret"}}, outbox, newTestLogger())
+	n.Backoff = time.Millisecond
+	n.MaxAttempts = 3
+	n.Notify(NewEvent(EventRepositoryDeleted, "user", "user", "repo", "", ""))
+	for i := 0; i < 3; i++ {
+		time.Sleep(5 * time.Millisecond)
+		n.deliverPending()
+	}
+
+	failures, err := n.Failures()
+	if err != nil || len(failures) != 1 {
+		t.Fatalf("Expected 1 failure, got %v: %v", failures, err)
+	}
+	if failures[0].Attempts != 3 || failures[0].LastError == "" {
+		t.Errorf("Wrong failure: %+v", failures[0])
+	}
+	if pending, _ := outbox.Pending(); len(pending) != 0 {
+		t.Errorf("Failed delivery still pending: %v", pending)
+	}
+}
+
+func TestWebhookOutboxSurvivesRestart(t *testing.T) {
+	rec, server := newReceiver(0)
+	defer server.Close()
+	outbox, cleanup := newTestOutbox(t)
+	defer cleanup()
+
+	endpoints := []Endpoint{{URL: server.URL, Secret: "secret"}}
+	// Not started, events are written to the outbox on stop
+	stopped := NewWebhookNotifier(endpoints, outbox, newTestLogger())
+	stopped.Notify(NewEvent(EventTagSet, "user", "user", "repo", "img1", "latest"))
+	stopped.Stop()
+
+	reopened, err := NewOutbox(outbox.dir, nil, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NewWebhookNotifier(endpoints, reopened, newTestLogger())
+	n.Start()
+	defer n.Stop()
+	waitReceived(t, rec)
+}
+
+// Reverses records, enough to tell sealed from plain files
+type reverseCipher struct{}
+
+func (reverseCipher) Seal(record []byte) ([]byte, error) {
+	sealed := make([]byte, len(record))
+	for i, b := range record {
+		sealed[len(record)-1-i] = b
+	}
+	return sealed, nil
+}
+
+func (c reverseCipher) Open(sealed []byte) ([]byte, error) {
+	return c.Seal(sealed)
+}
+
+func TestOutboxCipher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outbox, err := NewOutbox(dir, reverseCipher{}, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Delivery{ID: "d1", URL: "http://example.com", Event: NewEvent(EventTagSet, "user", "user", "repo", "img1", "latest")}
+	if err := outbox.Put(d); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path.Join(dir, "pending", "d1.json"))
+	if err != nil || bytes.Contains(b, []byte("example.com")) {
+		t.Errorf("Delivery not sealed: %q %v", b, err)
+	}
+	pending, err := outbox.Pending()
+	if err != nil || len(pending) != 1 || pending[0].URL != d.URL {
+		t.Errorf("Wrong pending deliveries: %+v %v", pending, err)
+	}
+}
+
+func TestOutboxInvalidFiles(t *testing.T) {
+	outbox, cleanup := newTestOutbox(t)
+	defer cleanup()
+	d := &Delivery{ID: "d1", URL: "http://example.com", Event: NewEvent(EventTagSet, "user", "user", "repo", "img1", "latest")}
+	if err := outbox.Put(d); err != nil {
+		t.Fatal(err)
+	}
+	// Left by a crash
+	if err := ioutil.WriteFile(path.Join(outbox.dir, "pending", "empty.json"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := outbox.Pending()
+	if err != nil || len(pending) != 1 || pending[0].ID != "d1" {
+		t.Errorf("Unreadable file held up deliveries: %+v %v", pending, err)
+	}
+	if _, err := os.Stat(path.Join(outbox.dir, "invalid", "pending-empty.json")); err != nil {
+		t.Errorf("Unreadable file not moved aside: %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+var (
+	ErrPushIncomplete = errors.New("Push incomplete, not all images committed")
+	ErrNoPushSession  = errors.New("No push session found")
+)
+
+// A pushSession groups all images authorized by one write token.
+// Tags pushed within a session are held back until the session is finished.
+type pushSession struct {
+	token      string
+	user       string
+	namespace  string
+	repository string
+	images     []string
+	committed  map[string]bool   // images committed by this session
+	tags       map[string]string // tag -> imageid, pending until finish
+	started    time.Time
+}
+
+func newPushSession(token, user, namespace, repository string, images []string) *pushSession {
+	return &pushSession{
+		token:      token,
+		user:       user,
+		namespace:  namespace,
+		repository: repository,
+		images:     images,
+		committed:  make(map[string]bool),
+		tags:       make(map[string]string),
+		started:    time.Now(),
+	}
+}
+
+// Starts a push session for the images announced by PUT /v1/repositories/{namespace}/{repository}/
+func (r *Registry) BeginPush(token, user, namespace, repository string, images []string) {
+	r.gcMu.RLock()
+	defer r.gcMu.RUnlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[token] = newPushSession(token, user, namespace, repository, images)
+}
+
+// Sets a tag, or holds it back if the token belongs to an unfinished push session.
+// Returns ErrTagProtected if a tag rule forbids setting the tag.
+func (r *Registry) PushTag(token, namespace, repository, imageID, tag string) error {
+	r.mu.Lock()
+	session, found := r.sessions[token]
+	if found && session.namespace == namespace && session.repository == repository {
+		session.tags[tag] = imageID
+		r.mu.Unlock()
+		return nil
+	}
+	r.mu.Unlock()
+	user, _ := r.authenticator.TokenUser(token)
+	return r.SetProtectedTag(user, namespace, repository, imageID, tag)
+}
+
+// Reports if any push session on namespace/repository is in progress
+func (r *Registry) HasPushSession(namespace, repository string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.sessions {
+		if s.namespace == namespace && s.repository == repository {
+			return true
+		}
+	}
+	return false
+}
+
+// Finishes a push session of user on namespace/repository, the oldest one whose images are all committed.
+// Images and tags become visible only if every image of the session is committed
+// and all its tags may be set, otherwise the push is rolled back.
+func (r *Registry) FinishPush(user, namespace, repository string) error {
+	// Between removing the session and setting its tags the images are reachable from neither
+	r.gcMu.RLock()
+	defer r.gcMu.RUnlock()
+	r.mu.Lock()
+	var candidates []*pushSession
+	for _, s := range r.sessions {
+		if s.user == user && s.namespace == namespace && s.repository == repository {
+			candidates = append(candidates, s)
+		}
+	}
+	r.mu.Unlock()
+	if len(candidates) == 0 {
+		return ErrNoPushSession
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].started.Before(candidates[j].started)
+	})
+
+	var session *pushSession
+	var missing string
+	for _, s := range candidates {
+		if missing = r.missingImage(s); missing == "" {
+			session = s
+			break
+		}
+	}
+	if session == nil && len(candidates) > 1 {
+		// Can not tell which push the client finished, the others might still be uploading
+		r.log.WithFields(logrus.Fields{"namespace": namespace, "repository": repository}).Warn("Push incomplete, no push session has all images committed")
+		return ErrPushIncomplete
+	}
+	if session == nil {
+		session = candidates[0]
+	}
+
+	r.mu.Lock()
+	if r.sessions[session.token] != session {
+		// Expired meanwhile
+		r.mu.Unlock()
+		return ErrNoPushSession
+	}
+	delete(r.sessions, session.token)
+	r.mu.Unlock()
+
+	if missing != "" {
+		r.log.WithFields(logrus.Fields{"namespace": namespace, "repository": repository, "image": missing}).Warn("Push incomplete, image missing")
+		r.rollbackPush(session)
+		return ErrPushIncomplete
+	}
+	r.tagMu.Lock()
+	defer r.tagMu.Unlock()
+	for tag, imageID := range session.tags {
+		// Another push might have set a protected tag in the meantime
+		if err := r.CheckTagProtection(session.user, namespace, repository, imageID, tag); err != nil {
+			r.log.WithFields(logrus.Fields{"namespace": namespace, "repository": repository, "tag": tag}).Warnf("Push rolled back, tag not set: %v", err)
+			r.rollbackPush(session)
+			return err
+		}
+	}
+	oldImages, _ := r.store.Images(namespace, repository)
+	if err := r.SetImages(namespace, repository, session.images); err != nil {
+		r.rollbackPush(session)
+		return err
+	}
+	oldTags := make(map[string]string)
+	for tag, imageID := range session.tags {
+		oldTags[tag], _ = r.store.Tag(namespace, repository, tag)
+		if err := r.SetTag(session.user, namespace, repository, imageID, tag); err != nil {
+			r.log.WithFields(logrus.Fields{"namespace": namespace, "repository": repository, "tag": tag}).Errorf("Push rolled back, could not set tag: %v", err)
+			r.restoreTags(session.user, namespace, repository, oldTags)
+			r.store.SetImages(namespace, repository, oldImages)
+			r.rollbackPush(session)
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns an image of the session which is not committed, empty if all are
+func (r *Registry) missingImage(session *pushSession) string {
+	for _, imageID := range session.images {
+		if _, found := r.store.ImageJSON(imageID); !found {
+			return imageID
+		}
+	}
+	return ""
+}
+
+// Points tags back to their previous image, tags mapped to an empty image id are deleted
+func (r *Registry) restoreTags(user, namespace, repository string, tags map[string]string) {
+	for tag, imageID := range tags {
+		var err error
+		if imageID == "" {
+			err = r.DeleteTag(user, namespace, repository, tag)
+		} else {
+			err = r.SetTag(user, namespace, repository, imageID, tag)
+		}
+		if err != nil && err != ErrTagNotFound {
+			r.log.WithFields(logrus.Fields{"namespace": namespace, "repository": repository, "tag": tag}).Errorf("Could not restore tag: %v", err)
+		}
+	}
+}
+
+// Rolls back all push sessions started before maxAge
+func (r *Registry) ExpirePushSessions(maxAge time.Duration) {
+	deadline := time.Now().Add(-maxAge)
+	var expired []*pushSession
+	r.mu.Lock()
+	for token, s := range r.sessions {
+		if s.started.Before(deadline) {
+			expired = append(expired, s)
+			delete(r.sessions, token)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, s := range expired {
+		r.log.WithFields(logrus.Fields{"namespace": s.namespace, "repository": s.repository}).Warn("Push session expired")
+		r.rollbackPush(s)
+	}
+}
+
+// Ends all unfinished push sessions and discards their uploads which were not committed,
+// those can not complete after a restart. Committed images are kept for the client to retry the push,
+// garbage collection removes them if they never get tagged.
+func (r *Registry) DiscardPushUploads() {
+	r.mu.Lock()
+	sessions := r.sessions
+	r.sessions = make(map[string]*pushSession)
+	r.mu.Unlock()
+
+	for _, s := range sessions {
+		r.log.WithFields(logrus.Fields{"namespace": s.namespace, "repository": s.repository}).Warn("Push session aborted")
+		r.rollbackPush(s)
+	}
+}
+
+// Records the commit of imageID in the session of token, returns nil if there is no session
+func (r *Registry) sessionCommitted(token string, imageID string) *pushSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	session, found := r.sessions[token]
+	if !found {
+		return nil
+	}
+	session.committed[imageID] = true
+	return session
+}
+
+// Discards the tmp data of images the session did not commit.
+// Committed images are left to garbage collection, another push might depend on them by now.
+func (r *Registry) rollbackPush(session *pushSession) {
+	for _, imageID := range session.images {
+		if !session.committed[imageID] {
+			r.discardImage(imageID)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/blang/crane/auth"
+	"github.com/blang/crane/store"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return logger
+}
+
+func newTestRegistry(t *testing.T) (*Registry, func()) {
+	dataDir, err := ioutil.TempDir("", "crane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.NewProxyStore(store.NewMemMetaStorage(), store.NewLocalFileStorage(dataDir, newTestLogger()))
+	return NewRegistry(s, auth.NewLocalAuthenticator(), newTestLogger()), func() { os.RemoveAll(dataDir) }
+}
+
+func pushTestImage(t *testing.T, r *Registry, token string, imageID string) {
+	imageJSON := "{\"id\": \"" + imageID + "\"}"
+	layer := "layer of " + imageID
+	if err := r.SetTmpImageJSON(imageID, imageJSON); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetTmpLayer(token, imageID, imageJSON, ioutil.NopCloser(strings.NewReader(layer))); err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte(imageJSON + "\n" + layer))
+	if !r.ValidateAndCommitLayer(token, imageID, hex.EncodeToString(hash[:])) {
+		t.Fatalf("Could not commit image %s", imageID)
+	}
+}
+
+func TestPushSessionFinish(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	r.BeginPush("token", "user", "user", "repo", []string{"img1", "img2"})
+	pushTestImage(t, r, "token", "img1")
+	pushTestImage(t, r, "token", "img2")
+	if err := r.PushTag("token", "user", "repo", "img2", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := r.Tag("user", "repo", "latest"); found {
+		t.Error("Tag visible before push finished")
+	}
+	if err := r.FinishPush("user", "user", "repo"); err != nil {
+		t.Fatalf("Finish push failed: %v", err)
+	}
+	if imageID, _ := r.Tag("user", "repo", "latest"); imageID != "img2" {
+		t.Errorf("Tag latest points to %q, expected img2", imageID)
+	}
+	if images, _ := r.Images("user", "repo"); len(images) != 2 {
+		t.Errorf("Repository images not set: %v", images)
+	}
+}
+
+func TestPushSessionRollback(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	r.BeginPush("token", "user", "user", "repo", []string{"img1", "img2"})
+	pushTestImage(t, r, "token", "img1")
+	r.PushTag("token", "user", "repo", "img2", "latest")
+
+	if err := r.FinishPush("user", "user", "repo"); err != ErrPushIncomplete {
+		t.Fatalf("Expected incomplete push, got %v", err)
+	}
+	if _, found := r.Tag("user", "repo", "latest"); found {
+		t.Error("Tag of incomplete push visible")
+	}
+	if images, _ := r.Images("user", "repo"); len(images) != 0 {
+		t.Errorf("Images of incomplete push visible: %v", images)
+	}
+	r.CollectGarbage(false, nil)
+	if _, found := r.ImageJSON("img1"); found {
+		t.Error("Image of incomplete push not garbage collected")
+	}
+}
+
+func TestPushSessionFinishComplete(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	// Two pushes of the same user to one repository, the second one still uploading
+	r.BeginPush("token1", "user", "user", "repo", []string{"img1"})
+	time.Sleep(time.Millisecond)
+	r.BeginPush("token2", "user", "user", "repo", []string{"img2"})
+	pushTestImage(t, r, "token1", "img1")
+	r.PushTag("token1", "user", "repo", "img1", "latest")
+
+	if err := r.FinishPush("user", "user", "repo"); err != nil {
+		t.Fatalf("Finish of complete push failed: %v", err)
+	}
+	if imageID, _ := r.Tag("user", "repo", "latest"); imageID != "img1" {
+		t.Errorf("Tag latest points to %q, expected img1", imageID)
+	}
+	if !r.HasPushSession("user", "repo") {
+		t.Fatal("Uploading push session finished")
+	}
+	if err := r.FinishPush("user", "user", "repo"); err != ErrPushIncomplete {
+		t.Errorf("Expected incomplete push, got %v", err)
+	}
+}
+
+func TestPushSessionExpire(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	r.BeginPush("token", "user", "user", "repo", []string{"img1"})
+	pushTestImage(t, r, "token", "img1")
+	r.ExpirePushSessions(0)
+	if _, found := r.ImageJSON("img1"); !found {
+		t.Error("Committed image of expired push removed before garbage collection")
+	}
+	if err := r.FinishPush("user", "user", "repo"); err != ErrNoPushSession {
+		t.Errorf("Expired session could be finished: %v", err)
+	}
+}
+
+func TestShutdownDiscardsPushUploads(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	r.BeginPush("token", "user", "user", "repo", []string{"img1", "img2"})
+	pushTestImage(t, r, "token", "img1")
+	if err := r.SetTmpImageJSON("img2", "{\"id\": \"img2\"}"); err != nil {
+		t.Fatal(err)
+	}
+	events, _ := r.SubscribeEvents()
+	r.CloseEventStreams()
+	if _, open := <-events; open {
+		t.Error("Event stream not closed")
+	}
+
+	// Shutdown waits for requests in progress
+	if !r.BeginRequest() {
+		t.Fatal("Request rejected before shutdown")
+	}
+	done := make(chan error)
+	go func() {
+		done <- r.Shutdown()
+	}()
+	select {
+	case <-done:
+		t.Fatal("Shutdown did not wait for request")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if r.BeginRequest() {
+		t.Error("Request started during shutdown")
+	}
+	r.EndRequest()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, found := r.ImageJSON("img1"); !found {
+		t.Error("Committed image of aborted push deleted")
+	}
+	if _, found := r.TmpImageJSON("img2"); found {
+		t.Error("Tmp image of aborted push not discarded")
+	}
+	if err := r.FinishPush("user", "user", "repo"); err != ErrNoPushSession {
+		t.Errorf("Aborted session could be finished: %v", err)
+	}
+}
+
+func TestFinishPushNeedsCredentials(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	r.authenticator = &passwordAuthenticator{r.authenticator}
+	api := NewRegistryAPI(r, newTestLogger())
+	finish := func(pass string) int {
+		req := httptest.NewRequest("PUT", "/v1/repositories/user/repo/images", strings.NewReader("[]"))
+		req.SetBasicAuth("user", pass)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := finish("wrong"); code != http.StatusNoContent {
+		t.Errorf("Expected 204 without push session, got %d", code)
+	}
+	r.BeginPush("token", "user", "user", "repo", []string{"img1"})
+	pushTestImage(t, r, "token", "img1")
+	if code := finish("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for push session with invalid credentials, got %d", code)
+	}
+	if code := finish("secret"); code != http.StatusNoContent {
+		t.Errorf("Could not finish push: %d", code)
+	}
+	if images, _ := r.Images("user", "repo"); len(images) != 1 {
+		t.Errorf("Push not finished: %v", images)
+	}
+}
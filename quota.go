@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strings"
+)
+
+var ErrQuotaExceeded = errors.New("Namespace quota exceeded")
+
+// Maps namespaces to their quota of committed bytes, the namespace "*" sets the default
+type Quotas map[string]int64
+
+// Rejects negative quotas
+func (q Quotas) Validate() error {
+	for namespace, quota := range q {
+		if quota < 0 {
+			return errors.New("Negative quota for namespace " + namespace)
+		}
+	}
+	return nil
+}
+
+// Returns the quota of namespace, 0 means unlimited
+func (q Quotas) Quota(namespace string) int64 {
+	if quota, found := q[namespace]; found {
+		return quota
+	}
+	return q["*"]
+}
+
+type NamespaceUsage struct {
+	Namespace string `json:"namespace"`
+	Used      int64  `json:"used"`
+	Quota     int64  `json:"quota"` // 0 means unlimited
+	Images    int    `json:"images"`
+}
+
+func (r *Registry) SetQuotas(quotas Quotas) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.quotas = quotas
+}
+
+// Calculates the committed bytes of all images in the repositories of namespace
+// and images committed by unfinished pushes. Layers shared between repositories are counted once.
+func (r *Registry) Usage(namespace string) NamespaceUsage {
+	images := make(map[string]bool)
+	r.mu.Lock()
+	quota := r.quotas.Quota(namespace)
+	for _, session := range r.sessions {
+		if session.namespace != namespace {
+			continue
+		}
+		for imageID := range session.committed {
+			images[imageID] = true
+		}
+	}
+	r.mu.Unlock()
+
+	for _, name := range r.store.Repositories() {
+		if !strings.HasPrefix(name, namespace+"/") {
+			continue
+		}
+		repoImages, err := r.store.Images(namespace, strings.TrimPrefix(name, namespace+"/"))
+		if err != nil {
+			continue
+		}
+		for _, imageID := range repoImages {
+			images[imageID] = true
+		}
+	}
+
+	usage := NamespaceUsage{
+		Namespace: namespace,
+		Quota:     quota,
+	}
+	for imageID := range images {
+		if size, found := r.store.Size(imageID); found {
+			usage.Used += size
+			usage.Images++
+		}
+	}
+	return usage
+}
+
+// Reports the usage of all namespaces
+func (r *Registry) UsageReport() []NamespaceUsage {
+	namespaces := make(map[string]bool)
+	for _, name := range r.store.Repositories() {
+		if parts := strings.SplitN(name, "/", 2); len(parts) == 2 {
+			namespaces[parts[0]] = true
+		}
+	}
+	var names []string
+	for namespace := range namespaces {
+		names = append(names, namespace)
+	}
+	sort.Strings(names)
+	var report []NamespaceUsage
+	for _, namespace := range names {
+		report = append(report, r.Usage(namespace))
+	}
+	return report
+}
+
+// Limits the upload of the layer of imageID to the remaining quota of the namespace of token, taken from
+// its push session or the token itself. Read bytes are reserved from the namespace while streaming,
+// so concurrent uploads share the remaining quota. Finish must be called when the upload is done,
+// with keep the reservation is held until the layer is committed or discarded.
+func (r *Registry) quotaReader(token string, imageID string, reader io.ReadCloser) (io.ReadCloser, func(keep bool)) {
+	r.mu.Lock()
+	session, found := r.sessions[token]
+	r.mu.Unlock()
+	namespace := ""
+	if found {
+		namespace = session.namespace
+	} else if namespace, found = r.authenticator.TokenNamespace(token); !found {
+		return reader, func(bool) {}
+	}
+	usage := r.Usage(namespace)
+	if usage.Quota == 0 {
+		return reader, func(bool) {}
+	}
+	q := &quotaReadCloser{
+		ReadCloser: reader,
+		registry:   r,
+		namespace:  namespace,
+		imageID:    imageID,
+		available:  usage.Quota - usage.Used,
+	}
+	return q, q.finish
+}
+
+// Bytes of a namespace reserved by an uploaded layer which is not committed yet
+type quotaReservation struct {
+	namespace string
+	bytes     int64
+}
+
+// Reserves read bytes from the quota of a namespace, fails with ErrQuotaExceeded
+// as soon as the uploads of the namespace exceed the available bytes
+type quotaReadCloser struct {
+	io.ReadCloser
+	registry  *Registry
+	namespace string
+	imageID   string
+	available int64 // quota minus the committed bytes of the namespace
+	reserved  int64
+}
+
+func (q *quotaReadCloser) Read(p []byte) (int, error) {
+	n, err := q.ReadCloser.Read(p)
+	r := q.registry
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.quotaReserved[q.namespace]+int64(n) > q.available {
+		return 0, ErrQuotaExceeded
+	}
+	r.quotaReserved[q.namespace] += int64(n)
+	q.reserved += int64(n)
+	return n, err
+}
+
+// Holds the reserved bytes for the uploaded layer or returns them to the namespace if the upload failed
+func (q *quotaReadCloser) finish(keep bool) {
+	r := q.registry
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// A previous upload of the same layer is replaced
+	r.releaseLayerQuota(q.imageID)
+	if keep {
+		r.layerReserved[q.imageID] = quotaReservation{namespace: q.namespace, bytes: q.reserved}
+	} else {
+		r.returnQuota(q.namespace, q.reserved)
+	}
+	q.reserved = 0
+}
+
+// Returns the bytes reserved by the uploaded layer of imageID once it is committed, then Usage
+// counts it, or discarded. Caller must hold r.mu.
+func (r *Registry) releaseLayerQuota(imageID string) {
+	if reservation, found := r.layerReserved[imageID]; found {
+		delete(r.layerReserved, imageID)
+		r.returnQuota(reservation.namespace, reservation.bytes)
+	}
+}
+
+// Caller must hold r.mu
+func (r *Registry) returnQuota(namespace string, bytes int64) {
+	r.quotaReserved[namespace] -= bytes
+	if r.quotaReserved[namespace] == 0 {
+		delete(r.quotaReserved, namespace)
+	}
+}
+
+// Fails with err as soon as more than remaining bytes are read
+type limitedReadCloser struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+}
+
+func (l *limitedReadCloser) Read(p []byte) (int, error) {
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return 0, l.err
+	}
+	return n, err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"github.com/blang/crane/auth"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	r.SetQuotas(Quotas{"*": 30, "big": 0})
+	r.BeginPush("token", "user", "user", "repo", []string{"img1", "img2"})
+	pushTestImage(t, r, "token", "img1") // 13 bytes
+	if usage := r.Usage("user"); usage.Used != 13 || usage.Quota != 30 {
+		t.Errorf("Wrong usage: %+v", usage)
+	}
+
+	r.SetTmpImageJSON("img2", "{}")
+	err := r.SetTmpLayer("token", "img2", "{}", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 20))))
+	if err != ErrQuotaExceeded {
+		t.Fatalf("Expected quota exceeded, got %v", err)
+	}
+	if _, found := r.store.TmpChecksum("img2"); found {
+		t.Error("Layer exceeding quota was stored")
+	}
+
+	r.BeginPush("bigtoken", "big", "big", "repo", []string{"img3"})
+	r.SetTmpImageJSON("img3", "{}")
+	if err := r.SetTmpLayer("bigtoken", "img3", "{}", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 100)))); err != nil {
+		t.Errorf("Unlimited namespace rejected layer: %v", err)
+	}
+}
+
+func TestQuotaConcurrentUploads(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	r.SetQuotas(Quotas{"*": 30})
+	// Uploads without a push session are charged to the namespace of their token
+	token, _ := r.Authenticator().Authorize("user", "pass", "user", "repo", []string{"img1", "img2"}, auth.O_WRONLY)
+
+	first, finishFirst := r.quotaReader(token, "img1", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 20))))
+	if _, err := ioutil.ReadAll(first); err != nil {
+		t.Fatalf("First upload rejected: %v", err)
+	}
+	second, finishSecond := r.quotaReader(token, "img2", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 20))))
+	if _, err := ioutil.ReadAll(second); err != ErrQuotaExceeded {
+		t.Errorf("Concurrent uploads exceeded the quota: %v", err)
+	}
+	finishSecond(false)
+	finishFirst(false)
+	if len(r.quotaReserved) != 0 {
+		t.Errorf("Reservations not released: %v", r.quotaReserved)
+	}
+}
+
+func TestQuotaUncommittedLayers(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	r.SetQuotas(Quotas{"*": 30})
+	r.BeginPush("token", "user", "user", "repo", []string{"img1", "img2"})
+
+	// An uploaded layer keeps its reservation until its checksum is put
+	r.SetTmpImageJSON("img1", "{}")
+	if err := r.SetTmpLayer("token", "img1", "{}", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 20)))); err != nil {
+		t.Fatal(err)
+	}
+	r.SetTmpImageJSON("img2", "{}")
+	if err := r.SetTmpLayer("token", "img2", "{}", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 20)))); err != ErrQuotaExceeded {
+		t.Fatalf("Uncommitted layers exceeded the quota: %v", err)
+	}
+
+	checksum, _ := r.store.TmpChecksum("img1")
+	if !r.ValidateAndCommitLayer("token", "img1", checksum) {
+		t.Fatal("Commit failed")
+	}
+	if len(r.quotaReserved) != 0 {
+		t.Errorf("Reservation of committed layer not released: %v", r.quotaReserved)
+	}
+	if usage := r.Usage("user"); usage.Used != 20 {
+		t.Errorf("Committed layer not counted: %+v", usage)
+	}
+}
+
+func TestUsageSharedLayers(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	pushTestImage(t, r, "", "img1")
+	pushTestImage(t, r, "", "img2")
+	r.SetImages("user", "repo1", []string{"img1"})
+	r.SetImages("user", "repo2", []string{"img1", "img2"})
+	if usage := r.Usage("user"); usage.Used != 26 || usage.Images != 2 {
+		t.Errorf("Shared layer counted twice: %+v", usage)
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clients without requests, transfers and uploads for this long are forgotten
+const rateLimitIdle = 10 * time.Minute
+
+// Limits of a single user or client ip, zero values are unlimited
+type RateLimit struct {
+	Requests          float64 `yaml:"requests"`           // Requests per second
+	Burst             int     `yaml:"burst"`              // Requests allowed at once, defaults to requests rounded up
+	Bandwidth         int64   `yaml:"bandwidth"`          // Layer bytes per second, uploads and downloads combined
+	ConcurrentUploads int     `yaml:"concurrent_uploads"` // Layer uploads in progress
+}
+
+func (l RateLimit) Validate() error {
+	if l.Requests < 0 || l.Burst < 0 || l.Bandwidth < 0 || l.ConcurrentUploads < 0 {
+		return errors.New("limits must not be negative")
+	}
+	return nil
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Requests > 0 || l.Bandwidth > 0 || l.ConcurrentUploads > 0
+}
+
+// Limits per user and per client ip, a request has to pass both.
+// Users are identified by their client certificate, token or basic auth credentials,
+// requests without valid credentials only count against the ip limit.
+// Requests from trusted proxies are limited by the client ip in X-Forwarded-For or X-Real-IP.
+type RateLimitConfig struct {
+	PerUser        RateLimit `yaml:"per_user"`
+	PerIP          RateLimit `yaml:"per_ip"`
+	TrustedProxies []string  `yaml:"trusted_proxies"` // IPs or CIDRs
+}
+
+func (c RateLimitConfig) Validate() error {
+	if err := c.PerUser.Validate(); err != nil {
+		return fmt.Errorf("per_user: %v", err)
+	}
+	if err := c.PerIP.Validate(); err != nil {
+		return fmt.Errorf("per_ip: %v", err)
+	}
+	_, err := parseNetworks(c.TrustedProxies)
+	return err
+}
+
+// Parses IPs and CIDRs, a single IP becomes a network of one address
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, s := range list {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.New("trusted_proxies: invalid ip or cidr " + s)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (c RateLimitConfig) Enabled() bool {
+	return c.PerUser.enabled() || c.PerIP.enabled()
+}
+
+// Token bucket allowing bursts of up to burst tokens, refilled with rate tokens per second.
+// Tokens may become negative, the debt is paid back before new tokens are available.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// Returns the time until n tokens are available
+func (b *tokenBucket) wait(now time.Time, n float64) time.Duration {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.wait(now, b.burst) == 0
+}
+
+type clientLimits struct {
+	requests   *tokenBucket // nil if unlimited
+	bandwidth  *tokenBucket // nil if unlimited
+	maxUploads int
+	uploads    int
+	lastSeen   time.Time
+}
+
+// RateLimiter enforces a RateLimitConfig for all clients
+type RateLimiter struct {
+	config    RateLimitConfig
+	proxies   []*net.IPNet
+	mu        sync.Mutex
+	clients   map[string]*clientLimits // user:<name> or ip:<addr>
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+// Config must be valid, invalid trusted proxies are ignored
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	proxies, _ := parseNetworks(config.TrustedProxies)
+	return &RateLimiter{
+		config:    config,
+		proxies:   proxies,
+		clients:   make(map[string]*clientLimits),
+		lastPrune: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// Returns the limiter keys of the request, the user key is missing for anonymous requests
+func (l *RateLimiter) keys(user string, req *http.Request) []string {
+	var keys []string
+	if user != "" && l.config.PerUser.enabled() {
+		keys = append(keys, "user:"+user)
+	}
+	if l.config.PerIP.enabled() {
+		keys = append(keys, "ip:"+l.clientIP(req))
+	}
+	return keys
+}
+
+// Returns the ip of the client. Behind trusted proxies X-Forwarded-For is read from the right
+// up to the first untrusted address, so clients can not choose their ip by sending the header themselves.
+// X-Real-IP is used if a trusted proxy sent no X-Forwarded-For.
+func (l *RateLimiter) clientIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if !l.trusted(ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			// Empty header or garbage
+			break
+		}
+		ip = hop
+		if !l.trusted(hop) {
+			return ip
+		}
+	}
+	if len(req.Header["X-Forwarded-For"]) == 0 {
+		if realIP := strings.TrimSpace(req.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+			return realIP
+		}
+	}
+	return ip
+}
+
+func (l *RateLimiter) trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range l.proxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the limits of key, l.mu must be held
+func (l *RateLimiter) client(key string, now time.Time) *clientLimits {
+	c, found := l.clients[key]
+	if !found {
+		limit := l.config.PerIP
+		if strings.HasPrefix(key, "user:") {
+			limit = l.config.PerUser
+		}
+		c = &clientLimits{maxUploads: limit.ConcurrentUploads}
+		if limit.Requests > 0 {
+			burst := float64(limit.Burst)
+			if burst == 0 {
+				burst = math.Ceil(limit.Requests)
+			}
+			c.requests = newTokenBucket(limit.Requests, burst, now)
+		}
+		if limit.Bandwidth > 0 {
+			c.bandwidth = newTokenBucket(float64(limit.Bandwidth), float64(limit.Bandwidth), now)
+		}
+		l.clients[key] = c
+	}
+	c.lastSeen = now
+	return c
+}
+
+// Forgets idle clients whose limits are fully recovered, l.mu must be held
+func (l *RateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for key, c := range l.clients {
+		if now.Sub(c.lastSeen) < rateLimitIdle || c.uploads > 0 {
+			continue
+		}
+		if (c.requests == nil || c.requests.full(now)) && (c.bandwidth == nil || c.bandwidth.full(now)) {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// Takes a request from the budget of all keys, or returns how long to wait if one of them is exhausted
+func (l *RateLimiter) Allow(keys []string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.prune(now)
+	var retryAfter time.Duration
+	for _, key := range keys {
+		if c := l.client(key, now); c.requests != nil {
+			if wait := c.requests.wait(now, 1); wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+	}
+	if retryAfter > 0 {
+		return retryAfter, false
+	}
+	for _, key := range keys {
+		if c := l.clients[key]; c.requests != nil {
+			c.requests.tokens--
+		}
+	}
+	return 0, true
+}
+
+// Checks that no key has used up its bandwidth, or returns how long to wait for it to recover
+func (l *RateLimiter) AllowTransfer(keys []string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var retryAfter time.Duration
+	for _, key := range keys {
+		if c := l.client(key, now); c.bandwidth != nil {
+			if wait := c.bandwidth.wait(now, 1); wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+	}
+	return retryAfter, retryAfter == 0
+}
+
+// Reserves an upload slot of all keys, release frees the slots once the upload is done
+func (l *RateLimiter) AcquireUpload(keys []string) (release func(), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for _, key := range keys {
+		if c := l.client(key, now); c.maxUploads > 0 && c.uploads >= c.maxUploads {
+			return nil, false
+		}
+	}
+	for _, key := range keys {
+		l.clients[key].uploads++
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			for _, key := range keys {
+				l.clients[key].uploads--
+			}
+		})
+	}, true
+}
+
+// Takes n bytes from the bandwidth of all keys and returns how long the transfer has to pause
+func (l *RateLimiter) transfer(keys []string, n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var pause time.Duration
+	for _, key := range keys {
+		if c := l.client(key, now); c.bandwidth != nil {
+			c.bandwidth.wait(now, 0)
+			c.bandwidth.tokens -= float64(n)
+			if wait := c.bandwidth.wait(now, 0); wait > pause {
+				pause = wait
+			}
+		}
+	}
+	return pause
+}
+
+// Reader limited to the bandwidth of keys
+type throttledReader struct {
+	io.ReadCloser
+	limiter *RateLimiter
+	keys    []string
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		time.Sleep(t.limiter.transfer(t.keys, n))
+	}
+	return n, err
+}
+
+// ResponseWriter limited to the bandwidth of keys
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	limiter *RateLimiter
+	keys    []string
+}
+
+func (t *throttledResponseWriter) Write(p []byte) (int, error) {
+	n, err := t.ResponseWriter.Write(p)
+	if n > 0 {
+		time.Sleep(t.limiter.transfer(t.keys, n))
+	}
+	return n, err
+}
+
+func (r *RegistryAPI) SetRateLimiter(limiter *RateLimiter) {
+	r.limiter = limiter
+}
+
+// Returns the authenticated user of the request for rate limiting: the certificate user,
+// the user of a valid token or the basic auth user if the credentials are valid.
+// Returns "" otherwise, so nobody can use up the budget of a foreign user.
+func (r *RegistryAPI) rateLimitUser(req *http.Request) string {
+	if token, valid := tokenHeader(req); valid {
+		user, _ := r.registry.Authenticator().TokenUser(token)
+		return user
+	}
+	if user, _, valid := r.authenticate(req); valid {
+		return user
+	}
+	return ""
+}
+
+// Takes a request from the budgets of the client, answers with 429 and returns false if exhausted
+func (r *RegistryAPI) limitRequest(w http.ResponseWriter, req *http.Request) bool {
+	if r.limiter == nil {
+		return true
+	}
+	if retryAfter, ok := r.limiter.Allow(r.limiter.keys(r.rateLimitUser(req), req)); !ok {
+		r.logger(req).WithField("retry_after", retryAfter).Warn("Request rate limited")
+		writeRateLimited(w, retryAfter)
+		return false
+	}
+	return true
+}
+
+// Throttles a layer download to the bandwidth of the client.
+// Answers with 429 and returns false if the client has used up its bandwidth.
+func (r *RegistryAPI) limitDownload(w http.ResponseWriter, req *http.Request) (http.ResponseWriter, bool) {
+	if r.limiter == nil {
+		return w, true
+	}
+	keys := r.limiter.keys(r.rateLimitUser(req), req)
+	if retryAfter, ok := r.limiter.AllowTransfer(keys); !ok {
+		r.logger(req).WithField("retry_after", retryAfter).Warn("Download rate limited")
+		writeRateLimited(w, retryAfter)
+		return w, false
+	}
+	return &throttledResponseWriter{ResponseWriter: w, limiter: r.limiter, keys: keys}, true
+}
+
+// Throttles a layer upload to the bandwidth of the client and takes one of its upload slots.
+// Answers with 429 and returns false if the client has used up its bandwidth or slots,
+// release must be called when the upload is done.
+func (r *RegistryAPI) limitUpload(w http.ResponseWriter, req *http.Request) (release func(), ok bool) {
+	if r.limiter == nil {
+		return func() {}, true
+	}
+	keys := r.limiter.keys(r.rateLimitUser(req), req)
+	retryAfter, ok := r.limiter.AllowTransfer(keys)
+	if ok {
+		release, ok = r.limiter.AcquireUpload(keys)
+		retryAfter = time.Second
+	}
+	if !ok {
+		r.logger(req).WithField("retry_after", retryAfter).Warn("Upload rate limited")
+		writeRateLimited(w, retryAfter)
+		return nil, false
+	}
+	req.Body = &throttledReader{ReadCloser: req.Body, limiter: r.limiter, keys: keys}
+	return release, true
+}
+
+// Answers with 429 and the seconds to wait in Retry-After
+func writeRateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write(JsonMsgRateLimited)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"github.com/blang/crane/auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := NewRateLimiter(RateLimitConfig{
+		PerUser: RateLimit{Requests: 2, Burst: 2, Bandwidth: 100, ConcurrentUploads: 1},
+	})
+	limiter.now = func() time.Time { return now }
+	keys := []string{"user:alice"}
+
+	for i := 0; i < 2; i++ {
+		if _, ok := limiter.Allow(keys); !ok {
+			t.Fatalf("Request %d within burst rejected", i)
+		}
+	}
+	if retryAfter, ok := limiter.Allow(keys); ok || retryAfter != 500*time.Millisecond {
+		t.Errorf("Request above burst allowed or wrong retry after %s", retryAfter)
+	}
+	if _, ok := limiter.Allow([]string{"user:bob"}); !ok {
+		t.Error("Other user limited")
+	}
+	now = now.Add(time.Second)
+	if _, ok := limiter.Allow(keys); !ok {
+		t.Error("Request after refill rejected")
+	}
+
+	if pause := limiter.transfer(keys, 300); pause != 2*time.Second {
+		t.Errorf("Expected 2s pause after transferring 3s of bandwidth, got %s", pause)
+	}
+	if retryAfter, ok := limiter.AllowTransfer(keys); ok || retryAfter <= 2*time.Second {
+		t.Errorf("Transfer allowed while bandwidth is used up, retry after %s", retryAfter)
+	}
+
+	release, ok := limiter.AcquireUpload(keys)
+	if !ok {
+		t.Fatal("First upload rejected")
+	}
+	if _, ok := limiter.AcquireUpload(keys); ok {
+		t.Error("Concurrent upload above limit allowed")
+	}
+	release()
+	release()
+	if _, ok := limiter.AcquireUpload(keys); !ok {
+		t.Error("Upload after release rejected")
+	}
+}
+
+// Only accepts the password "secret"
+type passwordAuthenticator struct {
+	auth.Authenticator
+}
+
+func (p *passwordAuthenticator) Authenticate(user string, pass string) bool {
+	return pass == "secret"
+}
+
+func TestRateLimitForeignUser(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	r.authenticator = &passwordAuthenticator{r.authenticator}
+	api := NewRegistryAPI(r, newTestLogger())
+	api.SetRateLimiter(NewRateLimiter(RateLimitConfig{PerUser: RateLimit{Requests: 1}}))
+	ping := func(pass string) int {
+		req := httptest.NewRequest("GET", "/v1/_ping", nil)
+		req.SetBasicAuth("victim", pass)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		ping("wrong")
+	}
+	if code := ping("secret"); code != http.StatusOK {
+		t.Errorf("Requests with wrong password used up the budget of the user: %d", code)
+	}
+	if code := ping("secret"); code != http.StatusTooManyRequests {
+		t.Errorf("Authenticated user not limited: %d", code)
+	}
+}
+
+func TestRateLimitedAPI(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	api := NewRegistryAPI(r, newTestLogger())
+	api.SetRateLimiter(NewRateLimiter(RateLimitConfig{
+		PerUser: RateLimit{Requests: 1},
+		PerIP:   RateLimit{Requests: 100},
+	}))
+	token, _ := r.Authenticator().Authorize("user", "pass", "user", "repo", nil, auth.O_RDONLY)
+	get := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v1/_ping", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Authorization", "Token Token signature="+token+",repository=\"user/repo\",access=read")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get("10.0.0.1:1234"); w.Code != http.StatusOK {
+		t.Fatalf("First request failed: %d", w.Code)
+	}
+	// The user limit applies across client ips
+	w := get("10.0.0.2:1234")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 with Retry-After 1, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestRateLimitTrustedProxies(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{
+		PerIP:          RateLimit{Requests: 1},
+		TrustedProxies: []string{"10.0.0.1", "192.168.0.0/16"},
+	})
+	for _, test := range []struct {
+		remoteAddr string
+		header     map[string]string
+		ip         string
+	}{
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "1.2.3.4"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4, 192.168.1.1"}, "1.2.3.4"},
+		{"10.0.0.1:1234", map[string]string{"X-Real-IP": "1.2.3.4"}, "1.2.3.4"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		// Headers of untrusted clients are ignored
+		{"5.5.5.5:1234", map[string]string{"X-Forwarded-For": "1.2.3.4", "X-Real-IP": "1.2.3.4"}, "5.5.5.5"},
+	} {
+		req := httptest.NewRequest("GET", "/v1/_ping", nil)
+		req.RemoteAddr = test.remoteAddr
+		for name, value := range test.header {
+			req.Header.Set(name, value)
+		}
+		if ip := limiter.clientIP(req); ip != test.ip {
+			t.Errorf("%s %v: expected client ip %s, got %s", test.remoteAddr, test.header, test.ip, ip)
+		}
+	}
+
+	if err := (RateLimitConfig{TrustedProxies: []string{"proxy"}}).Validate(); err == nil {
+		t.Error("Invalid trusted proxy accepted")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Read-only state of the registry, writes are rejected while it is set
+type ReadOnlyState struct {
+	ReadOnly bool   `json:"read_only"`
+	Reason   string `json:"reason,omitempty"`
+	since    time.Time
+}
+
+// Freezes or unfreezes writes, pulls keep working in read-only mode.
+// Freezing returns once write requests in progress, like layer uploads, are done.
+// Unfreezing extends the timeout of push sessions by the read-only time, they could not progress meanwhile.
+func (r *Registry) SetReadOnly(readOnly bool, reason string) {
+	r.mu.Lock()
+	previous := r.readOnly
+	r.readOnly = ReadOnlyState{ReadOnly: readOnly}
+	if readOnly {
+		r.readOnly.Reason = reason
+		r.readOnly.since = previous.since
+		if !previous.ReadOnly {
+			r.readOnly.since = time.Now()
+		}
+		if r.writes > 0 {
+			r.log.WithField("writes", r.writes).Info("Waiting for writes in progress")
+		}
+		// Stop waiting if the mode is switched back meanwhile
+		for r.writes > 0 && r.readOnly.ReadOnly {
+			r.writesDone.Wait()
+		}
+	} else if previous.ReadOnly {
+		frozen := time.Since(previous.since)
+		for _, session := range r.sessions {
+			session.started = session.started.Add(frozen)
+		}
+	}
+	r.mu.Unlock()
+	if readOnly {
+		r.log.WithField("reason", reason).Warn("Registry is read-only")
+	} else {
+		r.log.Info("Registry is writable")
+	}
+}
+
+func (r *Registry) ReadOnly() ReadOnlyState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.readOnly
+}
+
+// Registers a write request unless the registry is read-only, endWrite must be called when it is done
+func (r *Registry) beginWrite() (ReadOnlyState, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.readOnly.ReadOnly {
+		return r.readOnly, false
+	}
+	r.writes++
+	return r.readOnly, true
+}
+
+func (r *Registry) endWrite() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writes--
+	r.writesDone.Broadcast()
+}
+
+// Answers write requests with 503 while the registry is read-only and returns false.
+// Allowed writes are tracked until release is called, so switching to read-only can wait for them.
+// Login via POST /v1/users and switching the mode itself stay available.
+func (r *RegistryAPI) allowWrite(w http.ResponseWriter, req *http.Request) (release func(), ok bool) {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return func() {}, true
+	}
+	if req.URL.Path == "/v1/users/" || req.URL.Path == "/v1/admin/readonly" {
+		return func() {}, true
+	}
+	state, ok := r.registry.beginWrite()
+	if ok {
+		return r.registry.endWrite, true
+	}
+	r.logger(req).WithFields(logrus.Fields{"method": req.Method, "uri": req.RequestURI}).Info("Write rejected, registry is read-only")
+	msg := "Registry is read-only for maintenance"
+	if state.Reason != "" {
+		msg += ": " + state.Reason
+	}
+	b, _ := json.Marshal(map[string]string{"error": msg})
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(b)
+	return nil, false
+}
+
+// Returns whether the registry is read-only
+// Route: GET /v1/admin/readonly
+func (r *RegistryAPI) handleGetAdminReadOnly(w http.ResponseWriter, req *http.Request) {
+	if _, valid := r.adminAuth(req); !valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	json.NewEncoder(w).Encode(r.registry.ReadOnly())
+}
+
+// Switches the read-only mode, the body is a ReadOnlyState
+// Route: PUT /v1/admin/readonly
+func (r *RegistryAPI) handlePutAdminReadOnly(w http.ResponseWriter, req *http.Request) {
+	user, valid := r.adminAuth(req)
+	if !valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var state ReadOnlyState
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.logger(req).WithFields(logrus.Fields{"user": user, "read_only": state.ReadOnly}).Info("Read-only mode changed")
+	r.registry.SetReadOnly(state.ReadOnly, state.Reason)
+	json.NewEncoder(w).Encode(r.registry.ReadOnly())
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// SIGUSR1 makes the registry read-only, SIGUSR2 writable again
+func handleReadOnlySignals(registry *Registry) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			registry.SetReadOnly(sig == syscall.SIGUSR1, "signal "+sig.String())
+		}
+	}()
+}
@@ -0,0 +1,4 @@
+package main
+
+// Windows has no user signals, read-only mode is only available via the admin api
+func handleReadOnlySignals(registry *Registry) {}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/blang/crane/auth"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadOnlyMode(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	r.Authenticator().(*auth.LocalAuthenticator).SetAdmins([]string{"admin"})
+	api := NewRegistryAPI(r, newTestLogger())
+	pushTestImage(t, r, "", "img1")
+	request := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.SetBasicAuth("admin", "pass")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := request("PUT", "/v1/admin/readonly", `{"read_only": true, "reason": "gc"}`); w.Code != http.StatusOK {
+		t.Fatalf("Could not enable read-only mode: %d", w.Code)
+	}
+	w := request("PUT", "/v1/repositories/user/repo/", "[]")
+	var msg map[string]string
+	if w.Code != http.StatusServiceUnavailable || json.Unmarshal(w.Body.Bytes(), &msg) != nil || !strings.Contains(msg["error"], "gc") {
+		t.Errorf("Write not rejected: %d %s", w.Code, w.Body)
+	}
+	if w := request("DELETE", "/v1/repositories/user/repo", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Delete not rejected: %d", w.Code)
+	}
+	if w := request("GET", "/v1/images/img1/json", ""); w.Code != http.StatusOK {
+		t.Errorf("Pull rejected in read-only mode: %d", w.Code)
+	}
+
+	if w := request("PUT", "/v1/admin/readonly", `{"read_only": false}`); w.Code != http.StatusOK || r.ReadOnly().ReadOnly {
+		t.Fatalf("Could not disable read-only mode: %d", w.Code)
+	}
+	if w := request("PUT", "/v1/repositories/user/repo/", "[]"); w.Code == http.StatusServiceUnavailable {
+		t.Error("Write rejected after read-only mode was disabled")
+	}
+}
+
+func TestReadOnlyWaitsForWrites(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	r.BeginPush("token", "user", "user", "repo", []string{"img1"})
+
+	if _, ok := r.beginWrite(); !ok {
+		t.Fatal("Write rejected")
+	}
+	done := make(chan struct{})
+	go func() {
+		r.SetReadOnly(true, "migration")
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Read-only mode reported with a write in progress")
+	case <-time.After(20 * time.Millisecond):
+	}
+	r.endWrite()
+	<-done
+	if _, ok := r.beginWrite(); ok {
+		t.Error("Write allowed in read-only mode")
+	}
+
+	// Push sessions do not expire because of the read-only time
+	time.Sleep(20 * time.Millisecond)
+	r.SetReadOnly(false, "")
+	r.ExpirePushSessions(15 * time.Millisecond)
+	if err := r.FinishPush("user", "user", "repo"); err == ErrNoPushSession {
+		t.Error("Push session expired during read-only mode")
+	}
+}
@@ -1,10 +1,21 @@
 package main
 
 import (
+	"errors"
 	"github.com/blang/crane/auth"
+	"github.com/blang/crane/notify"
 	"github.com/blang/crane/store"
+	"github.com/sirupsen/logrus"
 	"io"
-	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrTagNotFound           = errors.New("Tag not found")
+	ErrTagHistoryNotFound    = errors.New("Tag history not found")
+	ErrRollbackImageNotFound = errors.New("Image not found in tag history")
 )
 
 type Image struct {
@@ -39,15 +50,51 @@ type ContainerConfig struct {
 }
 
 type Registry struct {
-	store         store.Store
-	authenticator auth.Authenticator
+	store           store.Store
+	authenticator   auth.Authenticator
+	mu              sync.Mutex
+	sessions        map[string]*pushSession // token -> session
+	gcMu            sync.RWMutex            // held by garbage collection, shared by pushes announcing or tagging images
+	tagRules        []TagRule
+	tagMu           sync.Mutex // held from checking tag protection until the tags are set or deleted
+	retentionRules  []RetentionRule
+	quotas          Quotas
+	quotaReserved   map[string]int64            // namespace -> bytes of layer uploads in progress or not yet committed
+	layerReserved   map[string]quotaReservation // image id -> reservation of its uncommitted layer
+	sinks           []notify.Sink
+	webhooks        *notify.WebhookNotifier
+	broker          *notify.Broker
+	scrubReport     *ScrubReport
+	uploadLimits    UploadLimits
+	dataDir         string
+	freeSpace       func(dir string) (int64, error)
+	rejectedUploads map[string]uint64 // reason -> count
+	badChecksums    uint64            // layers rejected by ValidateAndCommitLayer, updated atomically
+	readOnly        ReadOnlyState
+	writes          int        // write requests in progress
+	writesDone      *sync.Cond // signaled on r.mu when a write request ends
+	requestsMu      sync.Mutex
+	requests        sync.WaitGroup // requests in progress, Shutdown waits for them
+	closing         bool           // set by Shutdown, no new requests are started
+	log             logrus.FieldLogger
 }
 
-func NewRegistry(store store.Store, authenticator auth.Authenticator) *Registry {
-	return &Registry{
-		store:         store,
-		authenticator: authenticator,
+func NewRegistry(store store.Store, authenticator auth.Authenticator, logger logrus.FieldLogger) *Registry {
+	broker := notify.NewBroker()
+	r := &Registry{
+		store:           store,
+		authenticator:   authenticator,
+		log:             logger,
+		sessions:        make(map[string]*pushSession),
+		sinks:           []notify.Sink{broker},
+		broker:          broker,
+		freeSpace:       diskFree,
+		rejectedUploads: make(map[string]uint64),
+		quotaReserved:   make(map[string]int64),
+		layerReserved:   make(map[string]quotaReservation),
 	}
+	r.writesDone = sync.NewCond(&r.mu)
+	return r
 }
 
 func (r *Registry) SetTmpImageJSON(imageID string, json string) error {
@@ -70,18 +117,33 @@ func (r *Registry) Size(imageID string) (int64, bool) {
 	return r.store.Size(imageID)
 }
 
+func (r *Registry) Committed(imageID string) (time.Time, bool) {
+	return r.store.Committed(imageID)
+}
+
 func (r *Registry) Layer(imageID string) (store.ReadCloseSeeker, error) {
 	return r.store.Layer(imageID)
 }
 
-func (r *Registry) SetTmpLayer(imageID string, imageJSON string, reader io.ReadCloser) error {
-	checksum, size, err := r.store.SetTmpLayer(imageID, imageJSON, reader)
+// Stores the layer uploaded with token, aborts with ErrQuotaExceeded if the namespace runs out of quota,
+// ErrLayerTooLarge if the layer exceeds the maximum size and ErrInsufficientStorage if disk space is low
+func (r *Registry) SetTmpLayer(token string, imageID string, imageJSON string, reader io.ReadCloser) error {
+	if err := r.checkFreeSpace(); err != nil {
+		reader.Close()
+		r.rejectUpload(err)
+		return err
+	}
+	reader, finish := r.quotaReader(token, imageID, reader)
+	checksum, size, err := r.store.SetTmpLayer(imageID, imageJSON, r.layerSizeReader(reader))
+	finish(err == nil)
+	r.rejectUpload(err)
 	if err == nil {
 		//TODO: Check for errors
-		log.Printf("Put Tmp Layer of image %s with checksum %s", imageJSON, checksum)
+		r.log.WithFields(logrus.Fields{"image": imageID, "checksum": checksum, "size": size}).Info("Put Tmp Layer")
 		r.store.SetTmpChecksum(imageID, checksum)
 		r.store.SetTmpSize(imageID, size)
 	}
+	// A failed upload is discarded by the store, a concurrent upload of the same image must be kept
 	return err
 }
 
@@ -93,8 +155,59 @@ func (r *Registry) Tags(namespace string, repository string) (map[string]string,
 	return r.store.Tags(namespace, repository)
 }
 
-func (r *Registry) SetTag(namespace string, repository string, imageID string, tag string) error {
-	return r.store.SetTag(namespace, repository, imageID, tag)
+// Sets a tag on behalf of user and records the change in the tag history
+func (r *Registry) SetTag(user string, namespace string, repository string, imageID string, tag string) error {
+	oldImageID, _ := r.store.Tag(namespace, repository, tag)
+	if err := r.store.SetTag(namespace, repository, imageID, tag); err != nil {
+		return err
+	}
+	r.notify(notify.NewEvent(notify.EventTagSet, user, namespace, repository, imageID, tag))
+	return r.store.AddTagHistory(namespace, repository, tag, store.TagHistoryEntry{
+		Time:       time.Now(),
+		User:       user,
+		OldImageID: oldImageID,
+		ImageID:    imageID,
+	})
+}
+
+// Deletes a tag on behalf of user and records the deletion in the tag history
+func (r *Registry) DeleteTag(user string, namespace string, repository string, tag string) error {
+	oldImageID, found := r.store.Tag(namespace, repository, tag)
+	if !found {
+		return ErrTagNotFound
+	}
+	if err := r.store.DeleteTag(namespace, repository, tag); err != nil {
+		return err
+	}
+	return r.store.AddTagHistory(namespace, repository, tag, store.TagHistoryEntry{
+		Time:       time.Now(),
+		User:       user,
+		OldImageID: oldImageID,
+	})
+}
+
+// Deletes a repository with its tags, its images are left to the garbage collector.
+// Returns ErrTagProtected if a tag rule covers one of its tags, unless user is an admin.
+func (r *Registry) DeleteRepository(user string, namespace string, repository string) error {
+	r.tagMu.Lock()
+	defer r.tagMu.Unlock()
+	if !r.authenticator.IsAdmin(user) {
+		tags, _ := r.store.Tags(namespace, repository)
+		for tag := range tags {
+			if r.isProtectedTag(namespace, repository, tag) {
+				return ErrTagProtected
+			}
+		}
+	}
+	if err := r.store.DeleteRepository(namespace, repository); err != nil {
+		return err
+	}
+	r.notify(notify.NewEvent(notify.EventRepositoryDeleted, user, namespace, repository, "", ""))
+	return nil
+}
+
+func (r *Registry) TagHistory(namespace string, repository string, tag string) ([]store.TagHistoryEntry, bool) {
+	return r.store.TagHistory(namespace, repository, tag)
 }
 
 func (r *Registry) SetImages(namespace string, repository string, images []string) error {
@@ -109,21 +222,148 @@ func (r *Registry) Ancestry(imageID string) ([]string, error) {
 	return r.store.Ancestry(imageID)
 }
 
+func (r *Registry) AncestrySize(imageID string) (int64, bool) {
+	return r.store.AncestrySize(imageID)
+}
+
 func (r *Registry) SetTmpAncestry(imageID string, parentImageID string) error {
 	return r.store.SetTmpAncestry(imageID, parentImageID)
 }
 
+// Points tag back to a previous image, bypassing tag protection.
+// If imageID is empty the image the tag pointed to before its last change is used.
+func (r *Registry) RollbackTag(user string, namespace string, repository string, tag string, imageID string) (string, error) {
+	r.tagMu.Lock()
+	defer r.tagMu.Unlock()
+	history, found := r.store.TagHistory(namespace, repository, tag)
+	if !found || len(history) == 0 {
+		return "", ErrTagHistoryNotFound
+	}
+	if imageID == "" {
+		imageID = history[len(history)-1].OldImageID
+		if imageID == "" {
+			return "", ErrRollbackImageNotFound
+		}
+	} else {
+		previous := false
+		for _, entry := range history {
+			if entry.OldImageID == imageID || entry.ImageID == imageID {
+				previous = true
+				break
+			}
+		}
+		if !previous {
+			return "", ErrRollbackImageNotFound
+		}
+	}
+	if _, found := r.store.ImageJSON(imageID); !found {
+		return "", ErrRollbackImageNotFound
+	}
+	r.log.WithFields(logrus.Fields{"user": user, "namespace": namespace, "repository": repository, "image": imageID, "tag": tag}).Info("Rollback Tag")
+	return imageID, r.SetTag(user, namespace, repository, imageID, tag)
+}
+
+// Registers a sink for registry events
+func (r *Registry) AddSink(sink notify.Sink) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sinks = append(r.sinks, sink)
+}
+
+// Sends events to the webhook notifier
+func (r *Registry) SetWebhooks(webhooks *notify.WebhookNotifier) {
+	r.AddSink(webhooks)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.webhooks = webhooks
+}
+
+// Returns webhook deliveries which ran out of retries
+func (r *Registry) WebhookFailures() ([]*notify.Delivery, error) {
+	r.mu.Lock()
+	webhooks := r.webhooks
+	r.mu.Unlock()
+	if webhooks == nil {
+		return nil, nil
+	}
+	return webhooks.Failures()
+}
+
+// Writes queued webhook events to the outbox, so the events of a change survive a crash once it is acknowledged
+func (r *Registry) SyncEvents() {
+	r.mu.Lock()
+	webhooks := r.webhooks
+	r.mu.Unlock()
+	if webhooks != nil {
+		webhooks.Sync()
+	}
+}
+
+// Registers a request which may use the store, returns false once Shutdown started.
+// EndRequest must be called when the request is done.
+func (r *Registry) BeginRequest() bool {
+	r.requestsMu.Lock()
+	defer r.requestsMu.Unlock()
+	if r.closing {
+		return false
+	}
+	r.requests.Add(1)
+	return true
+}
+
+func (r *Registry) EndRequest() {
+	r.requests.Done()
+}
+
+// Waits for requests in progress, discards uploads of unfinished pushes,
+// stops webhook delivery and flushes the store.
+// Called after the server stopped accepting requests.
+func (r *Registry) Shutdown() error {
+	r.requestsMu.Lock()
+	r.closing = true
+	r.requestsMu.Unlock()
+	r.requests.Wait()
+	r.DiscardPushUploads()
+	r.mu.Lock()
+	webhooks := r.webhooks
+	r.mu.Unlock()
+	if webhooks != nil {
+		webhooks.Stop()
+	}
+	return store.Flush(r.store)
+}
+
+// Subscribes to all registry events
+func (r *Registry) SubscribeEvents() (<-chan notify.Event, func()) {
+	return r.broker.Subscribe(64)
+}
+
+// Ends all event subscriptions, so event streams do not hold up a shutdown
+func (r *Registry) CloseEventStreams() {
+	r.broker.Close()
+}
+
+func (r *Registry) notify(event notify.Event) {
+	r.mu.Lock()
+	sinks := r.sinks
+	r.mu.Unlock()
+	for _, sink := range sinks {
+		sink.Notify(event)
+	}
+}
+
 func (r *Registry) Authenticator() auth.Authenticator {
 	return r.authenticator
 }
 
-func (r *Registry) ValidateAndCommitLayer(imageID string, checksum string) bool {
+func (r *Registry) ValidateAndCommitLayer(token string, imageID string, checksum string) bool {
 	tmpChs, found := r.store.TmpChecksum(imageID)
 	if !found {
 		r.discardImage(imageID)
 		return false
 	}
 	if tmpChs != checksum {
+		atomic.AddUint64(&r.badChecksums, 1)
 		r.discardImage(imageID)
 		return false
 	}
@@ -137,11 +377,27 @@ func (r *Registry) ValidateAndCommitLayer(imageID string, checksum string) bool
 		r.discardImage(imageID)
 		return false
 	}
+	event := notify.NewEvent(notify.EventImageCommitted, "", "", "", imageID, "")
+	if session := r.sessionCommitted(token, imageID); session != nil {
+		event.User, event.Namespace, event.Repository = session.user, session.namespace, session.repository
+	}
+	r.mu.Lock()
+	r.releaseLayerQuota(imageID)
+	r.mu.Unlock()
+	r.notify(event)
 	return true
 
 }
 
+// Number of layers rejected because their checksum did not match the uploaded data
+func (r *Registry) ChecksumMismatches() uint64 {
+	return atomic.LoadUint64(&r.badChecksums)
+}
+
 func (r *Registry) discardImage(imageID string) bool {
+	r.mu.Lock()
+	r.releaseLayerQuota(imageID)
+	r.mu.Unlock()
 	r1 := r.store.DiscardTmpImage(imageID)
 	r2 := r.store.DiscardTmpLayer(imageID)
 	return (r1 && r2)
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTagHistoryRollback(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	pushTestImage(t, r, "", "img1")
+	pushTestImage(t, r, "", "img2")
+	r.SetTag("alice", "user", "repo", "img1", "latest")
+	r.SetTag("bob", "user", "repo", "img2", "latest")
+
+	history, found := r.TagHistory("user", "repo", "latest")
+	if !found || len(history) != 2 {
+		t.Fatalf("Expected 2 history entries, got %v", history)
+	}
+	if history[1].User != "bob" || history[1].OldImageID != "img1" || history[1].ImageID != "img2" {
+		t.Errorf("Wrong history entry: %+v", history[1])
+	}
+
+	imageID, err := r.RollbackTag("admin", "user", "repo", "latest", "")
+	if err != nil || imageID != "img1" {
+		t.Fatalf("Rollback to %q failed: %v", imageID, err)
+	}
+	if current, _ := r.Tag("user", "repo", "latest"); current != "img1" {
+		t.Errorf("Tag points to %q after rollback", current)
+	}
+	if _, err := r.RollbackTag("admin", "user", "repo", "latest", "unknown"); err != ErrRollbackImageNotFound {
+		t.Errorf("Rollback to unknown image: %v", err)
+	}
+	if _, err := r.RollbackTag("admin", "user", "repo", "missing", ""); err != ErrTagHistoryNotFound {
+		t.Errorf("Rollback of missing tag: %v", err)
+	}
+}
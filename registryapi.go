@@ -5,9 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/blang/crane/auth"
+	"github.com/blang/crane/notify"
 	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -22,29 +23,107 @@ var (
 	JsonMsgImageMissingChecksum  = []byte("{\"error\": \"Cannot set this image checksum\"}")
 	JsonMsgImageChecksumMissing  = []byte("{\"error\": \"Missing Image's checksum\"}")
 	JsonMsgImageChecksumMismatch = []byte("{\"error\": \"Checksum mismatch\"}")
+	JsonMsgPushIncomplete        = []byte("{\"error\": \"Push incomplete, not all images committed\"}")
+	JsonMsgTagProtected          = []byte("{\"error\": \"Tag is protected\"}")
+	JsonMsgTagHistoryNotFound    = []byte("{\"error\": \"Tag history not found\"}")
+	JsonMsgRollbackImageNotFound = []byte("{\"error\": \"Image not found in tag history\"}")
+	JsonMsgQuotaExceeded         = []byte("{\"error\": \"Namespace quota exceeded\"}")
+	JsonMsgRepositoryNotFound    = []byte("{\"error\": \"Repository not found\"}")
+	JsonMsgLayerTooLarge         = []byte("{\"error\": \"Layer exceeds the maximum layer size\"}")
+	JsonMsgInsufficientStorage   = []byte("{\"error\": \"Not enough free disk space, retry later\"}")
+	JsonMsgRateLimited           = []byte("{\"error\": \"Too many requests, retry later\"}")
+	JsonMsgShuttingDown          = []byte("{\"error\": \"Registry is shutting down, retry later\"}")
 )
 
 type RegistryAPI struct {
-	router   *mux.Router
-	registry *Registry
+	router    *mux.Router
+	registry  *Registry
+	log       logrus.FieldLogger
+	endpoints []string
+	limiter   *RateLimiter // nil if unlimited
 }
 
-func NewRegistryAPI(registry *Registry) *RegistryAPI {
+func NewRegistryAPI(registry *Registry, logger logrus.FieldLogger) *RegistryAPI {
 	r := &RegistryAPI{
 		router:   mux.NewRouter(),
 		registry: registry,
+		log:      logger,
 	}
 	r.registerEndPoints()
 	return r
 }
 
+// Sets the registry hosts announced in X-Docker-Endpoints, by default the request host is used
+func (r *RegistryAPI) SetEndpoints(endpoints []string) {
+	r.endpoints = endpoints
+}
+
+func (r *RegistryAPI) endpointsHeader(req *http.Request) string {
+	if len(r.endpoints) == 0 {
+		return req.Host
+	}
+	return strings.Join(r.endpoints, ",")
+}
+
 func (r *RegistryAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id := requestID(req)
+	logger := r.log.WithField("request_id", id)
+	req = withLogger(req, logger)
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("X-Docker-RegistryAPI-Version", "0.1.0")
-	log.Printf("%s: %s", req.Method, req.RequestURI)
-	log.Printf("Header: %s", req.Header)
-	log.Printf("Content-Length: %d", req.ContentLength)
-	r.router.ServeHTTP(w, req)
+	w.Header().Set("X-Request-Id", id)
+	logger.WithFields(logrus.Fields{
+		"method":         req.Method,
+		"uri":            req.RequestURI,
+		"content_length": req.ContentLength,
+	}).Info("Request")
+	logger.WithField("header", redactHeader(req.Header)).Debug("Request header")
+	if !r.registry.BeginRequest() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write(JsonMsgShuttingDown)
+		return
+	}
+	defer r.registry.EndRequest()
+	if !r.limitRequest(w, req) {
+		return
+	}
+	release, ok := r.allowWrite(w, req)
+	if !ok {
+		return
+	}
+	defer release()
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		r.router.ServeHTTP(w, req)
+	default:
+		synced := &eventSyncWriter{ResponseWriter: w, sync: r.registry.SyncEvents}
+		r.router.ServeHTTP(synced, req)
+		synced.syncOnce()
+	}
+}
+
+// Writes the events of a write request to the webhook outbox before its response is sent
+type eventSyncWriter struct {
+	http.ResponseWriter
+	sync   func()
+	synced bool
+}
+
+func (e *eventSyncWriter) syncOnce() {
+	if !e.synced {
+		e.synced = true
+		e.sync()
+	}
+}
+
+func (e *eventSyncWriter) WriteHeader(code int) {
+	e.syncOnce()
+	e.ResponseWriter.WriteHeader(code)
+}
+
+func (e *eventSyncWriter) Write(b []byte) (int, error) {
+	e.syncOnce()
+	return e.ResponseWriter.Write(b)
 }
 
 func (r *RegistryAPI) registerEndPoints() {
@@ -54,11 +133,13 @@ func (r *RegistryAPI) registerEndPoints() {
 	r.router.HandleFunc("/v1/repositories/{namespace}/{repository}/", r.handlePutRepository).Methods("PUT")
 	r.router.HandleFunc("/v1/repositories/{namespace}/{repository}/images", r.handlePutRepositoryImages).Methods("PUT")
 	r.router.HandleFunc("/v1/repositories/{namespace}/{repository}/images", r.handleGetRepositoryImages).Methods("GET")
-	r.router.HandleFunc("/v1/repositories/{namespace}/{repository}", r.handleDummy).Methods("DELETE")
+	r.router.HandleFunc("/v1/repositories/{namespace}/{repository}", r.handleDeleteRepository).Methods("DELETE")
+	r.router.HandleFunc("/v1/repositories/{namespace}/{repository}/", r.handleDeleteRepository).Methods("DELETE")
 	r.router.HandleFunc("/v1/repositories/{namespace}/{repository}/tags", r.handleGetRepositoryTags).Methods("GET")
 	r.router.HandleFunc("/v1/repositories/{namespace}/{repository}/tags/{tags}", r.handleGetRepositoryTag).Methods("GET")
 	r.router.HandleFunc("/v1/repositories/{namespace}/{repository}/tags/{tags}", r.handlePutRepositoryTag).Methods("PUT")
 	r.router.HandleFunc("/v1/repositories/{namespace}/{repository}/tags/{tags}", r.handleDummy).Methods("DELETE")
+	r.router.HandleFunc("/v1/repositories/{namespace}/{repository}/tags/{tags}/history", r.handleGetRepositoryTagHistory).Methods("GET")
 
 	r.router.HandleFunc("/v1/images/{image_id}/json", r.handleGetImageJson).Methods("GET")
 	r.router.HandleFunc("/v1/images/{image_id}/json", r.handlePutImageJson).Methods("PUT")
@@ -71,15 +152,26 @@ func (r *RegistryAPI) registerEndPoints() {
 	r.router.HandleFunc("/v1/images/{image_id}/ancestry", r.handleGetAncestry).Methods("GET")
 	r.router.HandleFunc("/v1/users/", r.handlePostUser).Methods("POST")
 	r.router.HandleFunc("/v1/users/", r.handleGetUser).Methods("GET")
+
+	r.router.HandleFunc("/v1/events", r.handleGetEvents).Methods("GET")
+
+	r.router.HandleFunc("/v1/admin/repositories/{namespace}/{repository}/tags/{tags}/rollback", r.handlePostAdminTagRollback).Methods("POST")
+	r.router.HandleFunc("/v1/admin/readonly", r.handleGetAdminReadOnly).Methods("GET")
+	r.router.HandleFunc("/v1/admin/readonly", r.handlePutAdminReadOnly).Methods("PUT")
+	r.router.HandleFunc("/v1/admin/retention", r.handleGetAdminRetention).Methods("GET")
+	r.router.HandleFunc("/v1/admin/scrub", r.handleGetAdminScrub).Methods("GET")
+	r.router.HandleFunc("/v1/admin/usage", r.handleGetAdminUsage).Methods("GET")
+	r.router.HandleFunc("/v1/admin/webhooks/failures", r.handleGetAdminWebhookFailures).Methods("GET")
+	r.router.HandleFunc("/v1/namespaces/{namespace}/usage", r.handleGetNamespaceUsage).Methods("GET")
 	//
 }
 
 func (r *RegistryAPI) handleDummy(w http.ResponseWriter, req *http.Request) {
 	b, _ := ioutil.ReadAll(req.Body)
 	if len(b) < 500 {
-		log.Printf("Body: %s (%d)", b, len(b))
+		r.logger(req).Debugf("Body: %s (%d)", b, len(b))
 	} else {
-		log.Printf("Body length: %s", len(b))
+		r.logger(req).Debugf("Body length: %d", len(b))
 	}
 
 }
@@ -99,14 +191,14 @@ func (r *RegistryAPI) handlePostUser(w http.ResponseWriter, req *http.Request) {
 // Status: 403 : Account inactive
 // Route: GET /v1/users
 func (r *RegistryAPI) handleGetUser(w http.ResponseWriter, req *http.Request) {
-	user, pass, valid := authHeader(req)
+	user, _, valid := r.credentials(req)
 	if !valid {
-		log.Println("Authheader not valid")
+		r.logger(req).Warn("Authheader not valid")
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-	if !r.registry.Authenticator().Authenticate(user, pass) {
-		log.Println("Authentication failed")
+	if _, _, valid := r.authenticate(req); !valid {
+		r.logger(req).WithField("user", user).Warn("Authentication failed")
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -122,22 +214,23 @@ func (r ImageRef) String() string {
 }
 
 func (r *RegistryAPI) handlePutRepository(w http.ResponseWriter, req *http.Request) {
-	log.Println("Put Repository")
+	logger := r.logger(req)
 	vars := mux.Vars(req)
 	namespace, found1 := vars["namespace"]
 	repository, found2 := vars["repository"]
 	if !(found1 && found2) {
-		log.Println("Put Repository namespace, repository url wrong")
+		logger.Warn("Put Repository namespace, repository url wrong")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	user, pass, valid := authHeader(req)
+	user, pass, valid := r.credentials(req)
 	if !valid {
-		log.Printf("Not valid header")
+		logger.Warn("Authheader not valid")
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	logger = logger.WithFields(logrus.Fields{"user": user, "namespace": namespace, "repository": repository})
 
 	var imageRefs []ImageRef
 	err := json.NewDecoder(req.Body).Decode(&imageRefs)
@@ -152,19 +245,47 @@ func (r *RegistryAPI) handlePutRepository(w http.ResponseWriter, req *http.Reque
 
 	token, granted := r.registry.Authenticator().Authorize(user, pass, namespace, repository, imageIds, auth.O_WRONLY)
 	if !granted {
-		log.Printf("Not granted %s", repository)
+		logger.Warn("Write access not granted")
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 	setTokenHeaders(w, token, namespace, repository, auth.O_WRONLY)
 
-	err = r.registry.SetImages(namespace, repository, imageIds)
-	if err != nil {
+	// Images and tags become visible when the push is finished by PUT /v1/repositories/{namespace}/{repository}/images
+	r.registry.BeginPush(token, user, namespace, repository, imageIds)
+	w.Header().Set("X-Docker-Endpoints", r.endpointsHeader(req))
+	logger.WithField("images", imageIds).Info("Put Repository")
+}
+
+// Handles deletion of a repository by its owner
+// Route: DELETE /v1/repositories/{namespace}/{repository}
+func (r *RegistryAPI) handleDeleteRepository(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	namespace, found1 := vars["namespace"]
+	repository, found2 := vars["repository"]
+	if !(found1 && found2) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	w.Header().Set("X-Docker-Endpoints", req.Host) //TODO: Make http host or config
-	log.Printf("Put Repository Images: %s:%s %q", namespace, repository, imageRefs)
+	user, _, valid := r.authenticate(req)
+	if !valid || !r.registry.Authenticator().HasPermNamespace(user, namespace) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	err := r.registry.DeleteRepository(user, namespace, repository)
+	if err == ErrTagProtected {
+		r.logger(req).WithFields(logrus.Fields{"user": user, "namespace": namespace, "repository": repository}).Warn("Repository with protected tags not deleted")
+		w.WriteHeader(http.StatusConflict)
+		w.Write(JsonMsgTagProtected)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(JsonMsgRepositoryNotFound)
+		return
+	}
+	r.logger(req).WithFields(logrus.Fields{"user": user, "namespace": namespace, "repository": repository}).Info("Deleted Repository")
+	w.Write([]byte("\"\""))
 }
 
 func (r *RegistryAPI) handleGetImageJson(w http.ResponseWriter, req *http.Request) {
@@ -195,7 +316,20 @@ func (r *RegistryAPI) handleGetImageJson(w http.ResponseWriter, req *http.Reques
 	}
 	w.Header().Set("X-Docker-Payload-Checksum", "sha256:"+checksum)
 	w.Header().Set("X-Docker-Size", strconv.FormatInt(size, 10))
-	w.Write([]byte(imageJSON))
+	// Image json is served without authorization, so shared caches may keep it
+	committed := r.setImmutableHeaders(w, imageID, checksum, "json", "public")
+	http.ServeContent(w, req, "image.json", committed, strings.NewReader(imageJSON))
+}
+
+// Committed images never change, so the payload checksum of json and layer is a stable ETag.
+// It is prefixed with the resource, so the json and layer of an image have different ETags.
+// Visibility is public for responses which do not depend on authorization, private otherwise.
+// Returns the commit time for Last-Modified, which is zero if unknown.
+func (r *RegistryAPI) setImmutableHeaders(w http.ResponseWriter, imageID string, checksum string, resource string, visibility string) time.Time {
+	w.Header().Set("ETag", "\""+resource+"-sha256:"+checksum+"\"")
+	w.Header().Set("Cache-Control", visibility+", max-age=31536000, immutable")
+	committed, _ := r.registry.Committed(imageID)
+	return committed
 }
 
 func (r *RegistryAPI) handlePutImageJson(w http.ResponseWriter, req *http.Request) {
@@ -272,7 +406,7 @@ func (r *RegistryAPI) handlePutImageChecksum(w http.ResponseWriter, req *http.Re
 	startIndex := found256 + len("sha256:")
 	checksum := checksumHeader[startIndex:]
 
-	if !r.registry.ValidateAndCommitLayer(imageID, checksum) {
+	if !r.registry.ValidateAndCommitLayer(token, imageID, checksum) {
 		w.WriteHeader(http.StatusConflict)
 		w.Write(JsonMsgImageChecksumMismatch)
 		return
@@ -301,10 +435,33 @@ func (r *RegistryAPI) handlePutImageLayer(w http.ResponseWriter, req *http.Reque
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	release, allowed := r.limitUpload(w, req)
+	if !allowed {
+		return
+	}
+	defer release()
 
-	err := r.registry.SetTmpLayer(imageID, imageJSON, req.Body)
+	err := r.registry.SetTmpLayer(token, imageID, imageJSON, req.Body)
+	if err == ErrQuotaExceeded {
+		r.logger(req).WithField("image", imageID).Warnf("Could not set layer: %v", err)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write(JsonMsgQuotaExceeded)
+		return
+	}
+	if err == ErrLayerTooLarge {
+		r.logger(req).WithField("image", imageID).Warnf("Could not set layer: %v", err)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write(JsonMsgLayerTooLarge)
+		return
+	}
+	if err == ErrInsufficientStorage {
+		r.logger(req).WithField("image", imageID).Warnf("Could not set layer: %v", err)
+		w.WriteHeader(http.StatusInsufficientStorage)
+		w.Write(JsonMsgInsufficientStorage)
+		return
+	}
 	if err != nil {
-		log.Printf("Could not set layer: %v", err)
+		r.logger(req).WithField("image", imageID).Errorf("Could not set layer: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -327,14 +484,24 @@ func (r *RegistryAPI) handleGetImageLayer(w http.ResponseWriter, req *http.Reque
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	w, allowed := r.limitDownload(w, req)
+	if !allowed {
+		return
+	}
 
 	reader, err := r.registry.Layer(imageID)
 	if err != nil {
-		log.Printf("Could not set layer: %v", err)
+		r.logger(req).WithField("image", imageID).Errorf("Could not get layer: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	http.ServeContent(w, req, "layer.bin", time.Now(), reader)
+	defer reader.Close()
+	var committed time.Time
+	// Layers need a pull token, shared caches must not serve them to other clients
+	if checksum, found := r.registry.Checksum(imageID); found {
+		committed = r.setImmutableHeaders(w, imageID, checksum, "layer", "private")
+	}
+	http.ServeContent(w, req, "layer.bin", committed, reader)
 
 }
 
@@ -364,8 +531,27 @@ func (r *RegistryAPI) handlePutRepositoryTag(w http.ResponseWriter, req *http.Re
 		return
 	}
 
-	log.Printf("Set Tag: %s/%s: %s:%s", namespace, repository, imageID, tags)
-	r.registry.SetTag(namespace, repository, imageID, tags)
+	user, _ := r.registry.Authenticator().TokenUser(token)
+	logger := r.logger(req).WithFields(logrus.Fields{"user": user, "namespace": namespace, "repository": repository, "image": imageID, "tag": tags})
+	if err := r.registry.CheckTagProtection(user, namespace, repository, imageID, tags); err != nil {
+		logger.Warnf("Set Tag denied: %v", err)
+		w.WriteHeader(http.StatusConflict)
+		w.Write(JsonMsgTagProtected)
+		return
+	}
+
+	logger.Info("Set Tag")
+	err = r.registry.PushTag(token, namespace, repository, imageID, tags)
+	if err == ErrTagProtected {
+		logger.Warnf("Set Tag denied: %v", err)
+		w.WriteHeader(http.StatusConflict)
+		w.Write(JsonMsgTagProtected)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 }
 
 func (r *RegistryAPI) handleGetRepositoryTag(w http.ResponseWriter, req *http.Request) {
@@ -391,15 +577,222 @@ func (r *RegistryAPI) handleGetRepositoryTag(w http.ResponseWriter, req *http.Re
 
 	imageID, found := r.registry.Tag(namespace, repository, tag)
 	if !found {
-		log.Printf("Get Tag not found: %s/%s: %s", namespace, repository, tag)
+		r.logger(req).WithFields(logrus.Fields{"namespace": namespace, "repository": repository, "tag": tag}).Info("Get Tag not found")
 		w.WriteHeader(http.StatusNotFound)
 		w.Write(JsonMsgTagNotFound)
 		return
 	}
-	log.Printf("Get Tag: %s/%s: %s:%s", namespace, repository, imageID, tag)
+	r.logger(req).WithFields(logrus.Fields{"namespace": namespace, "repository": repository, "image": imageID, "tag": tag}).Info("Get Tag")
 	w.Write([]byte("\"" + imageID + "\""))
 }
 
+func (r *RegistryAPI) handleGetRepositoryTagHistory(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	namespace, found1 := vars["namespace"]
+	repository, found2 := vars["repository"]
+	tag, found3 := vars["tags"]
+	if !(found1 && found2 && found3) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	token, validToken := tokenHeader(req)
+	if !validToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !r.registry.Authenticator().HasPermPullTag(token, namespace, repository, tag) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	history, found := r.registry.TagHistory(namespace, repository, tag)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(JsonMsgTagHistoryNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(history)
+}
+
+// Handles rollback of a tag to a previous image by an admin.
+// Body: {"image": "<id>"}, an empty body rolls back to the image before the last change.
+// Route: POST /v1/admin/repositories/{namespace}/{repository}/tags/{tag}/rollback
+func (r *RegistryAPI) handlePostAdminTagRollback(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	namespace, found1 := vars["namespace"]
+	repository, found2 := vars["repository"]
+	tag, found3 := vars["tags"]
+	if !(found1 && found2 && found3) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	user, valid := r.adminAuth(req)
+	if !valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var rollback struct {
+		Image string `json:"image"`
+	}
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(strings.TrimSpace(string(b))) > 0 {
+		if err := json.Unmarshal(b, &rollback); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	imageID, err := r.registry.RollbackTag(user, namespace, repository, tag, rollback.Image)
+	switch err {
+	case nil:
+	case ErrTagHistoryNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(JsonMsgTagHistoryNotFound)
+		return
+	case ErrRollbackImageNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(JsonMsgRollbackImageNotFound)
+		return
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("\"" + imageID + "\""))
+}
+
+// Reports which tags and images the retention rules would delete, without deleting them
+// Route: GET /v1/admin/retention
+func (r *RegistryAPI) handleGetAdminRetention(w http.ResponseWriter, req *http.Request) {
+	if _, valid := r.adminAuth(req); !valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	json.NewEncoder(w).Encode(r.registry.ApplyRetention(true))
+}
+
+// Returns the report of the last background scrub
+// Route: GET /v1/admin/scrub
+func (r *RegistryAPI) handleGetAdminScrub(w http.ResponseWriter, req *http.Request) {
+	if _, valid := r.adminAuth(req); !valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	report, found := r.registry.LastScrubReport()
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// Reports storage usage and quota of all namespaces
+// Route: GET /v1/admin/usage
+func (r *RegistryAPI) handleGetAdminUsage(w http.ResponseWriter, req *http.Request) {
+	if _, valid := r.adminAuth(req); !valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	json.NewEncoder(w).Encode(r.registry.UsageReport())
+}
+
+// Reports storage usage and quota of a namespace
+// Route: GET /v1/namespaces/{namespace}/usage
+func (r *RegistryAPI) handleGetNamespaceUsage(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	namespace, found := vars["namespace"]
+	if !found {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	user, _, valid := r.authenticate(req)
+	if !valid || !r.registry.Authenticator().HasPermNamespace(user, namespace) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	json.NewEncoder(w).Encode(r.registry.Usage(namespace))
+}
+
+// Streams registry events as server-sent events.
+// Only events of namespaces the user may access are sent, optionally filtered by the namespace query parameter.
+// Route: GET /v1/events?namespace={namespace}
+func (r *RegistryAPI) handleGetEvents(w http.ResponseWriter, req *http.Request) {
+	user, _, valid := r.authenticate(req)
+	if !valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	authenticator := r.registry.Authenticator()
+	namespace := req.URL.Query().Get("namespace")
+	if namespace != "" && !authenticator.HasPermNamespace(user, namespace) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	events, cancel := r.registry.SubscribeEvents()
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-heartbeat.C:
+			w.Write([]byte(": heartbeat\n\n"))
+		case event, open := <-events:
+			if !open {
+				return
+			}
+			if namespace != "" && event.Namespace != namespace {
+				continue
+			}
+			if !authenticator.HasPermNamespace(user, event.Namespace) {
+				continue
+			}
+			b, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, b)
+		}
+		flusher.Flush()
+	}
+}
+
+// Lists webhook deliveries which ran out of retries
+// Route: GET /v1/admin/webhooks/failures
+func (r *RegistryAPI) handleGetAdminWebhookFailures(w http.ResponseWriter, req *http.Request) {
+	if _, valid := r.adminAuth(req); !valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	failures, err := r.registry.WebhookFailures()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if failures == nil {
+		failures = []*notify.Delivery{}
+	}
+	json.NewEncoder(w).Encode(failures)
+}
+
 func (r *RegistryAPI) handleGetRepositoryTags(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	namespace, found1 := vars["namespace"]
@@ -443,16 +836,40 @@ func (r *RegistryAPI) handlePutRepositoryImages(w http.ResponseWriter, req *http
 		return
 	}
 
-	// No Auth here because it's an empty endpoint result of dockers strange design.
+	// No Auth needed because it's an empty endpoint result of dockers strange design,
+	// but docker sends its credentials and this call marks the end of a push.
+	// A push session can only be finished with valid credentials.
 
 	b, _ := ioutil.ReadAll(req.Body)
 	bodyStr := string(b)
-	log.Printf("Put Repository Images: %s:%s %v", namespace, repository, string(b))
-	if bodyStr == "[]" {
-		w.WriteHeader(http.StatusNoContent)
+	logger := r.logger(req).WithFields(logrus.Fields{"namespace": namespace, "repository": repository})
+	logger.WithField("body", bodyStr).Info("Put Repository Images")
+	if bodyStr != "[]" {
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	w.WriteHeader(http.StatusBadRequest)
+	user, _, valid := r.authenticate(req)
+	if !valid && r.registry.HasPushSession(namespace, repository) {
+		logger.Warn("Push session not finished, invalid credentials")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if valid {
+		err := r.registry.FinishPush(user, namespace, repository)
+		if err == ErrTagProtected {
+			logger.Warnf("Finish push failed: %v", err)
+			w.WriteHeader(http.StatusConflict)
+			w.Write(JsonMsgTagProtected)
+			return
+		}
+		if err != nil && err != ErrNoPushSession {
+			logger.Warnf("Finish push failed: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(JsonMsgPushIncomplete)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
 
 }
 
@@ -464,12 +881,13 @@ func (r *RegistryAPI) handleGetRepositoryImages(w http.ResponseWriter, req *http
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	user, pass, valid := authHeader(req)
+	user, pass, valid := r.credentials(req)
 	if !valid {
-		log.Printf("Not valid header")
+		r.logger(req).Warn("Authheader not valid")
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	logger := r.logger(req).WithFields(logrus.Fields{"user": user, "namespace": namespace, "repository": repository})
 
 	images, err := r.registry.Images(namespace, repository)
 	if err != nil {
@@ -480,19 +898,19 @@ func (r *RegistryAPI) handleGetRepositoryImages(w http.ResponseWriter, req *http
 
 	token, granted := r.registry.Authenticator().Authorize(user, pass, namespace, repository, images, auth.O_RDONLY)
 	if !granted {
-		log.Printf("Not granted %s", repository)
+		logger.Warn("Read access not granted")
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 	setTokenHeaders(w, token, namespace, repository, auth.O_RDONLY)
 
-	w.Header().Set("X-Docker-Endpoints", req.Host) //TODO: Make http host or config
+	w.Header().Set("X-Docker-Endpoints", r.endpointsHeader(req))
 
 	var imageRefList []*ImageRef
 	for _, imageID := range images {
 		imageRefList = append(imageRefList, &ImageRef{ID: imageID})
 	}
-	log.Printf("Get Repository Images: %s:%s %v", namespace, repository, images)
+	logger.WithField("images", images).Info("Get Repository Images")
 	json.NewEncoder(w).Encode(imageRefList)
 }
 
@@ -518,23 +936,65 @@ func (r *RegistryAPI) handleGetAncestry(w http.ResponseWriter, req *http.Request
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	log.Printf("Ancestry for image %s: %v", imageID, ancestryArr)
+	r.logger(req).WithFields(logrus.Fields{"image": imageID, "ancestry": ancestryArr}).Debug("Ancestry")
+	if size, found := r.registry.AncestrySize(imageID); found {
+		w.Header().Set("X-Crane-Ancestry-Size", strconv.FormatInt(size, 10))
+	}
 	json.NewEncoder(w).Encode(&ancestryArr)
 }
 
+// Checks the credentials of an admin
+func (r *RegistryAPI) adminAuth(req *http.Request) (string, bool) {
+	user, _, valid := r.authenticate(req)
+	if !valid {
+		return "", false
+	}
+	if !r.registry.Authenticator().IsAdmin(user) {
+		r.logger(req).WithField("user", user).Warn("User is no admin")
+		return "", false
+	}
+	return user, true
+}
+
+// Returns the user of a verified TLS client certificate
+func (r *RegistryAPI) certificateUser(req *http.Request) (string, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	return r.registry.Authenticator().AuthenticateCertificate(req.TLS.VerifiedChains[0][0])
+}
+
+// Returns the credentials of the request, a verified client certificate takes precedence over basic auth.
+// Certificate users have an empty password.
+func (r *RegistryAPI) credentials(req *http.Request) (string, string, bool) {
+	if user, valid := r.certificateUser(req); valid {
+		return user, "", true
+	}
+	return authHeader(req)
+}
+
+// Returns the credentials of the request if they are authenticated
+func (r *RegistryAPI) authenticate(req *http.Request) (string, string, bool) {
+	if user, valid := r.certificateUser(req); valid {
+		return user, "", true
+	}
+	user, pass, valid := authHeader(req)
+	if !valid || !r.registry.Authenticator().Authenticate(user, pass) {
+		return "", "", false
+	}
+	return user, pass, true
+}
+
 func authHeader(req *http.Request) (string, string, bool) {
 	const authBasic = "Basic "
 	auth := req.Header.Get("Authorization")
-	log.Printf("Header is %s", auth)
 	if !strings.HasPrefix(auth, authBasic) {
-		log.Println("Has no prefx")
 		return "", "", false
 	}
 	str, err := base64.StdEncoding.DecodeString(auth[len(authBasic):])
 	if err != nil {
 		return "", "", false
 	}
-	log.Printf("Auth string is: %s", str)
 
 	creds := strings.SplitN(string(str), ":", 2)
 	if len(creds) != 2 {
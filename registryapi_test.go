@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/blang/crane/auth"
+	"github.com/blang/crane/notify"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConditionalImageRequests(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	api := NewRegistryAPI(r, newTestLogger())
+	pushTestImage(t, r, "", "img1")
+	readToken, _ := r.Authenticator().Authorize("user", "pass", "user", "repo", []string{"img1"}, auth.O_RDONLY)
+
+	etags := make(map[string]bool)
+	// Anonymous json may be kept by shared caches, layers need a token
+	for path, visibility := range map[string]string{"/v1/images/img1/json": "public", "/v1/images/img1/layer": "private"} {
+		get := func(header string, value string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", path, nil)
+			req.Header.Set("Authorization", "Token Token signature="+readToken+",repository=\"user/repo\",access=read")
+			if header != "" {
+				req.Header.Set(header, value)
+			}
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			return w
+		}
+
+		w := get("", "")
+		etag := w.Header().Get("ETag")
+		if w.Code != http.StatusOK || etag == "" || !strings.HasPrefix(w.Header().Get("Cache-Control"), visibility+",") {
+			t.Fatalf("%s: status %d, headers %v", path, w.Code, w.Header())
+		}
+		if etags[etag] {
+			t.Errorf("%s: ETag %s shared with another resource", path, etag)
+		}
+		etags[etag] = true
+		lastModified, err := http.ParseTime(w.Header().Get("Last-Modified"))
+		if err != nil || time.Since(lastModified) > time.Minute {
+			t.Errorf("%s: Last-Modified is not the commit time: %q", path, w.Header().Get("Last-Modified"))
+		}
+		if again := get("", ""); again.Header().Get("ETag") != etag {
+			t.Errorf("%s: ETag changed from %s to %s", path, etag, again.Header().Get("ETag"))
+		}
+		if w := get("If-None-Match", etag); w.Code != http.StatusNotModified {
+			t.Errorf("%s: If-None-Match returned %d", path, w.Code)
+		}
+		if w := get("If-Modified-Since", w.Header().Get("Last-Modified")); w.Code != http.StatusNotModified {
+			t.Errorf("%s: If-Modified-Since returned %d", path, w.Code)
+		}
+		if w := get("If-None-Match", "\"sha256:other\""); w.Code != http.StatusOK {
+			t.Errorf("%s: Non-matching If-None-Match returned %d", path, w.Code)
+		}
+	}
+}
+
+func TestWriteRequestPersistsEvents(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outbox, err := notify.NewOutbox(dir, nil, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not started, only the request writes the events to the outbox
+	r.SetWebhooks(notify.NewWebhookNotifier([]notify.Endpoint{{URL: "http://example.com"}}, outbox, newTestLogger()))
+	api := NewRegistryAPI(r, newTestLogger())
+	pushTestImage(t, r, "", "img1")
+	token, _ := r.Authenticator().Authorize("user", "pass", "user", "repo", []string{"img1"}, auth.O_WRONLY)
+
+	req := httptest.NewRequest("PUT", "/v1/repositories/user/repo/tags/latest", strings.NewReader("\"img1\""))
+	req.Header.Set("Authorization", "Token Token signature="+token+",repository=\"user/repo\",access=write")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Set tag failed with %d", w.Code)
+	}
+	pending, err := outbox.Pending()
+	if err != nil || len(pending) != 2 || pending[1].Event.Tag != "latest" {
+		t.Errorf("Events not persisted before the response: %+v %v", pending, err)
+	}
+}
+
+func TestEventStreamFilteredByNamespace(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	server := httptest.NewServer(NewRegistryAPI(r, newTestLogger()))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/v1/events", nil)
+	req.SetBasicAuth("alice", "pass")
+	resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Subscribing failed with %d", resp.StatusCode)
+	}
+
+	// Events are streamed in order, so the first one received shows the others were dropped
+	r.notify(notify.NewEvent(notify.EventTagSet, "bob", "bob", "repo", "img1", "latest"))
+	r.notify(notify.NewEvent(notify.EventImageCommitted, "", "", "", "img2", ""))
+	r.notify(notify.NewEvent(notify.EventTagSet, "alice", "alice", "repo", "img3", "latest"))
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if !strings.HasPrefix(scanner.Text(), "data: ") {
+			continue
+		}
+		var event notify.Event
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(scanner.Text(), "data: ")), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Namespace != "alice" || event.ImageID != "img3" {
+			t.Errorf("Event of another namespace sent: %+v", event)
+		}
+		return
+	}
+	t.Fatalf("No event received: %v", scanner.Err())
+}
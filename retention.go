@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RetentionRule removes old tags matching Pattern in repositories matching Repository.
+// Tags beyond the KeepLast most recently set ones are deleted if they were set before MaxAge.
+// A zero KeepLast or an empty MaxAge disables the respective limit. Protected tags are never deleted.
+type RetentionRule struct {
+	Repository string `json:"repository" yaml:"repository"`
+	Pattern    string `json:"pattern" yaml:"pattern"`
+	KeepLast   int    `json:"keep_last" yaml:"keep_last"`
+	MaxAge     string `json:"max_age" yaml:"max_age"` // e.g. "720h"
+	maxAge     time.Duration
+}
+
+func (rule RetentionRule) matches(namespace, repository string) bool {
+	match, err := path.Match(rule.Repository, namespace+"/"+repository)
+	return err == nil && match
+}
+
+type RetentionReport struct {
+	DryRun  bool                `json:"dry_run"`
+	Time    time.Time           `json:"time"`
+	Tags    []RetentionTagEntry `json:"tags"`   // deleted tags
+	Images  []string            `json:"images"` // garbage collected images
+	Skipped []RetentionTagEntry `json:"skipped"`
+}
+
+type RetentionTagEntry struct {
+	Namespace  string    `json:"namespace"`
+	Repository string    `json:"repository"`
+	Tag        string    `json:"tag"`
+	ImageID    string    `json:"image"`
+	Updated    time.Time `json:"updated"`
+	Reason     string    `json:"reason"`
+}
+
+// Checks rules without modifying them
+func ValidateRetentionRules(rules []RetentionRule) error {
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Repository, ""); err != nil {
+			return errors.New("Invalid repository pattern " + rule.Repository)
+		}
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return errors.New("Invalid tag pattern " + rule.Pattern)
+		}
+		if rule.MaxAge != "" {
+			if _, err := time.ParseDuration(rule.MaxAge); err != nil {
+				return errors.New("Invalid max_age " + rule.MaxAge)
+			}
+		}
+		if rule.KeepLast < 0 || (rule.KeepLast == 0 && rule.MaxAge == "") {
+			return errors.New("Retention rule needs keep_last or max_age")
+		}
+	}
+	return nil
+}
+
+// Validates rules and sets them with their max age parsed, invalid rules are not set
+func (r *Registry) SetRetentionRules(rules []RetentionRule) error {
+	if err := ValidateRetentionRules(rules); err != nil {
+		return err
+	}
+	parsed := make([]RetentionRule, len(rules))
+	for i, rule := range rules {
+		if rule.MaxAge != "" {
+			rule.maxAge, _ = time.ParseDuration(rule.MaxAge)
+		}
+		parsed[i] = rule
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.retentionRules = parsed
+	return nil
+}
+
+// Deletes expired tags and garbage collects unreferenced images.
+// With dryRun nothing is changed but the report lists what would be deleted.
+func (r *Registry) ApplyRetention(dryRun bool) *RetentionReport {
+	r.mu.Lock()
+	rules := r.retentionRules
+	r.mu.Unlock()
+
+	now := time.Now()
+	report := &RetentionReport{
+		DryRun: dryRun,
+		Time:   now,
+	}
+	deletedTags := make(map[string]string) // namespace/repository:tag -> image id
+	for _, name := range r.store.Repositories() {
+		parts := strings.SplitN(name, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		namespace, repository := parts[0], parts[1]
+		for _, rule := range rules {
+			if !rule.matches(namespace, repository) {
+				continue
+			}
+			for _, entry := range r.expiredTags(namespace, repository, rule, now) {
+				if _, deleted := deletedTags[name+":"+entry.Tag]; deleted {
+					continue
+				}
+				if r.isProtectedTag(namespace, repository, entry.Tag) {
+					entry.Reason = "protected"
+					report.Skipped = append(report.Skipped, entry)
+					continue
+				}
+				if !dryRun {
+					deleted, err := r.deleteExpiredTag(namespace, repository, entry.Tag, entry.ImageID)
+					if err != nil {
+						r.log.WithFields(logrus.Fields{"namespace": namespace, "repository": repository, "tag": entry.Tag}).Errorf("Retention: Could not delete tag: %v", err)
+						continue
+					}
+					if !deleted {
+						entry.Reason = "changed"
+						report.Skipped = append(report.Skipped, entry)
+						continue
+					}
+				}
+				deletedTags[name+":"+entry.Tag] = entry.ImageID
+				report.Tags = append(report.Tags, entry)
+			}
+		}
+	}
+	report.Images = r.CollectGarbage(dryRun, deletedTags)
+	return report
+}
+
+// Deletes an expired tag unless a push moved it away from imageID meanwhile
+func (r *Registry) deleteExpiredTag(namespace, repository, tag, imageID string) (bool, error) {
+	r.tagMu.Lock()
+	defer r.tagMu.Unlock()
+	if current, found := r.store.Tag(namespace, repository, tag); !found || current != imageID {
+		return false, nil
+	}
+	if err := r.DeleteTag("", namespace, repository, tag); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Returns the tags matching rule which exceed its limits, oldest first
+func (r *Registry) expiredTags(namespace, repository string, rule RetentionRule, now time.Time) []RetentionTagEntry {
+	tags, _ := r.store.Tags(namespace, repository)
+	var entries []RetentionTagEntry
+	for tag, imageID := range tags {
+		if match, err := path.Match(rule.Pattern, tag); err != nil || !match {
+			continue
+		}
+		entry := RetentionTagEntry{
+			Namespace:  namespace,
+			Repository: repository,
+			Tag:        tag,
+			ImageID:    imageID,
+		}
+		if history, found := r.store.TagHistory(namespace, repository, tag); found && len(history) > 0 {
+			entry.Updated = history[len(history)-1].Time
+		}
+		entries = append(entries, entry)
+	}
+	// Newest first
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Updated.After(entries[j].Updated)
+	})
+	if rule.KeepLast >= len(entries) {
+		return nil
+	}
+	var expired []RetentionTagEntry
+	for _, entry := range entries[rule.KeepLast:] {
+		if rule.maxAge > 0 && now.Sub(entry.Updated) < rule.maxAge {
+			continue
+		}
+		if rule.maxAge > 0 {
+			entry.Reason = "older than " + rule.MaxAge
+		} else {
+			entry.Reason = "exceeds keep_last"
+		}
+		expired = append([]RetentionTagEntry{entry}, expired...)
+	}
+	return expired
+}
+
+// Reports if any tag protection rule covers the tag
+func (r *Registry) isProtectedTag(namespace, repository, tag string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rule := range r.tagRules {
+		if rule.matches(namespace, repository, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Deletes all committed images which are not reachable from any tag or an unfinished push.
+// Tags listed in ignoreTags (namespace/repository:tag -> image id) are treated as deleted
+// as long as they still point to the listed image.
+// Returns the ids of the deleted images. Pushes can not begin or finish meanwhile,
+// so sessions and tags are a consistent snapshot.
+func (r *Registry) CollectGarbage(dryRun bool, ignoreTags map[string]string) []string {
+	r.gcMu.Lock()
+	defer r.gcMu.Unlock()
+	reachable := make(map[string]bool)
+	r.mu.Lock()
+	for _, session := range r.sessions {
+		for _, imageID := range session.images {
+			reachable[imageID] = true
+		}
+	}
+	r.mu.Unlock()
+
+	repositories := r.store.Repositories()
+	for _, name := range repositories {
+		parts := strings.SplitN(name, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		tags, _ := r.store.Tags(parts[0], parts[1])
+		for tag, imageID := range tags {
+			if ignored, found := ignoreTags[name+":"+tag]; found && ignored == imageID {
+				continue
+			}
+			ancestry, err := r.store.Ancestry(imageID)
+			if err != nil {
+				continue
+			}
+			for _, id := range ancestry {
+				reachable[id] = true
+			}
+		}
+	}
+
+	var garbage []string
+	for _, imageID := range r.store.ImageIDs() {
+		if !reachable[imageID] {
+			garbage = append(garbage, imageID)
+		}
+	}
+	sort.Strings(garbage)
+	if dryRun || len(garbage) == 0 {
+		return garbage
+	}
+
+	for _, imageID := range garbage {
+		r.log.WithField("image", imageID).Info("Garbage collect image")
+		r.store.DeleteImage(imageID)
+		r.store.DeleteLayer(imageID)
+	}
+	// Remove collected images from repository image lists
+	for _, name := range repositories {
+		parts := strings.SplitN(name, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		images, err := r.store.Images(parts[0], parts[1])
+		if err != nil {
+			continue
+		}
+		var kept []string
+		for _, imageID := range images {
+			if reachable[imageID] {
+				kept = append(kept, imageID)
+			}
+		}
+		if len(kept) != len(images) {
+			r.store.SetImages(parts[0], parts[1], kept)
+		}
+	}
+	return garbage
+}
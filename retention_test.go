@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRetention(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	for _, imageID := range []string{"img1", "img2", "img3", "img4"} {
+		pushTestImage(t, r, "", imageID)
+	}
+	r.SetImages("user", "repo", []string{"img1", "img2", "img3", "img4"})
+	r.SetTag("user", "user", "repo", "img1", "ci-1")
+	r.SetTag("user", "user", "repo", "img2", "ci-2")
+	r.SetTag("user", "user", "repo", "img3", "ci-3")
+	r.SetTag("user", "user", "repo", "img4", "release")
+	r.SetTagRules([]TagRule{{Repository: "*/*", Pattern: "ci-1", Immutable: true}})
+	if err := r.SetRetentionRules([]RetentionRule{{Repository: "user/*", Pattern: "ci-*", KeepLast: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	report := r.ApplyRetention(true)
+	if len(report.Tags) != 1 || report.Tags[0].Tag != "ci-2" {
+		t.Fatalf("Dry run should delete ci-2, got %+v", report.Tags)
+	}
+	if len(report.Skipped) != 1 || report.Skipped[0].Tag != "ci-1" {
+		t.Errorf("Protected tag ci-1 not skipped: %+v", report.Skipped)
+	}
+	if len(report.Images) != 1 || report.Images[0] != "img2" {
+		t.Errorf("Dry run should collect img2, got %v", report.Images)
+	}
+	if _, found := r.Tag("user", "repo", "ci-2"); !found {
+		t.Fatal("Dry run deleted tag")
+	}
+
+	r.ApplyRetention(false)
+	if _, found := r.Tag("user", "repo", "ci-2"); found {
+		t.Error("Expired tag not deleted")
+	}
+	if _, found := r.ImageJSON("img2"); found {
+		t.Error("Unreferenced image not collected")
+	}
+	for _, tag := range []string{"ci-1", "ci-3", "release"} {
+		if _, found := r.Tag("user", "repo", tag); !found {
+			t.Errorf("Tag %s deleted", tag)
+		}
+	}
+	if images, _ := r.Images("user", "repo"); len(images) != 3 {
+		t.Errorf("Collected image still listed in repository: %v", images)
+	}
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	pushTestImage(t, r, "", "img1")
+	r.SetTag("user", "user", "repo", "img1", "old")
+	// max_age is parsed without validating the rules first
+	rule := RetentionRule{Repository: "*/*", Pattern: "*", MaxAge: "1h"}
+	if err := r.SetRetentionRules([]RetentionRule{rule}); err != nil {
+		t.Fatal(err)
+	}
+
+	if report := r.ApplyRetention(true); len(report.Tags) != 0 {
+		t.Errorf("Recent tag expired: %+v", report.Tags)
+	}
+}
+
+func TestRetentionRepointedTag(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	pushTestImage(t, r, "", "img1")
+	pushTestImage(t, r, "", "img2")
+	r.SetTag("user", "user", "repo", "img1", "ci-1")
+
+	// A push moves ci-1 to img2 after retention found it expired
+	r.SetTag("user", "user", "repo", "img2", "ci-1")
+	if deleted, err := r.deleteExpiredTag("user", "repo", "ci-1", "img1"); deleted || err != nil {
+		t.Errorf("Re-pointed tag deleted: %v", err)
+	}
+	r.CollectGarbage(false, map[string]string{"user/repo:ci-1": "img1"})
+	if _, found := r.ImageJSON("img2"); !found {
+		t.Error("Image of re-pointed tag collected")
+	}
+	if _, found := r.ImageJSON("img1"); found {
+		t.Error("Unreferenced image not collected")
+	}
+}
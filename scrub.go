@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/blang/crane/store"
+	"github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"time"
+)
+
+type ScrubReport struct {
+	Time        time.Time    `json:"time"`
+	Images      int          `json:"images"` // checked images
+	Issues      []ScrubIssue `json:"issues"`
+	Quarantined []string     `json:"quarantined"`
+}
+
+type ScrubIssue struct {
+	ImageID    string `json:"image,omitempty"`
+	Repository string `json:"repository,omitempty"` // namespace/repository
+	Problem    string `json:"problem"`
+}
+
+func (r *ScrubReport) issue(imageID, repository, problem string) {
+	r.Issues = append(r.Issues, ScrubIssue{ImageID: imageID, Repository: repository, Problem: problem})
+}
+
+// Re-hashes every committed layer with its image JSON and compares it against the stored checksum,
+// checks that parents and images referenced by repositories exist.
+// With quarantine, images with a missing or corrupted layer are removed from the metadata
+// and their layer is moved aside, storages without quarantine support delete the layer.
+func Scrub(s store.Store, quarantine bool, log logrus.FieldLogger) ScrubReport {
+	report := ScrubReport{Time: time.Now()}
+	var corrupted []string
+	for _, imageID := range s.ImageIDs() {
+		report.Images++
+		imageJSON, found1 := s.ImageJSON(imageID)
+		checksum, found2 := s.Checksum(imageID)
+		if !(found1 && found2) {
+			report.issue(imageID, "", "metadata incomplete")
+			continue
+		}
+		actual, err := layerChecksum(s, imageID, imageJSON)
+		if err != nil {
+			report.issue(imageID, "", "layer unreadable: "+err.Error())
+			corrupted = append(corrupted, imageID)
+		} else if actual != checksum {
+			report.issue(imageID, "", "checksum mismatch: "+actual)
+			corrupted = append(corrupted, imageID)
+		}
+		ancestry, err := s.Ancestry(imageID)
+		if err != nil {
+			report.issue(imageID, "", "ancestry unreadable: "+err.Error())
+			continue
+		}
+		for _, parentID := range ancestry[1:] {
+			if _, found := s.ImageJSON(parentID); !found {
+				report.issue(imageID, "", "missing parent "+parentID)
+			}
+		}
+	}
+
+	for _, name := range s.Repositories() {
+		parts := strings.SplitN(name, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		images, _ := s.Images(parts[0], parts[1])
+		for _, imageID := range images {
+			if _, found := s.ImageJSON(imageID); !found {
+				report.issue(imageID, name, "missing image")
+			}
+		}
+		tags, _ := s.Tags(parts[0], parts[1])
+		for tag, imageID := range tags {
+			if _, found := s.ImageJSON(imageID); !found {
+				report.issue(imageID, name, "tag "+tag+" references missing image")
+			}
+		}
+	}
+
+	if !quarantine {
+		return report
+	}
+	for _, imageID := range corrupted {
+		err := store.QuarantineLayer(s, imageID)
+		if err == store.ErrQuarantineUnsupported {
+			err = nil
+			s.DeleteLayer(imageID)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.WithField("image", imageID).Errorf("Could not quarantine layer: %v", err)
+			continue
+		}
+		s.DeleteImage(imageID)
+		report.Quarantined = append(report.Quarantined, imageID)
+		log.WithField("image", imageID).Warn("Image quarantined")
+	}
+	return report
+}
+
+// Scrubs the store of the registry and keeps the report
+func (r *Registry) Scrub(quarantine bool) ScrubReport {
+	report := Scrub(r.store, quarantine, r.log)
+	r.mu.Lock()
+	r.scrubReport = &report
+	r.mu.Unlock()
+	return report
+}
+
+// Returns the report of the last scrub
+func (r *Registry) LastScrubReport() (ScrubReport, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.scrubReport == nil {
+		return ScrubReport{}, false
+	}
+	return *r.scrubReport, true
+}
+
+// Runs crane fsck -config <config> [-quarantine], prints the report as json.
+// Exits with 1 if issues were found and with 2 if the metadata driver is not persistent, like the memory driver.
+// The server must not be running, the file metadata driver only reads its metadata on start.
+func fsckCommand(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	configFile := flags.String("config", "", "YAML config file")
+	quarantine := flags.Bool("quarantine", false, "Quarantine corrupted images")
+	flags.Parse(args)
+
+	config, err := LoadConfig(*configFile)
+	if err == nil {
+		err = config.ApplyEnv(os.Environ())
+	}
+	if err == nil {
+		err = config.Validate()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	log, err := NewLogger(config.Log.Level, config.Log.Format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	metaStorage, fileStorage, err := buildStorage(config, log)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// A fresh non-persistent meta storage is empty, the scrub would always come out clean
+	if !store.IsPersistent(metaStorage) {
+		fmt.Fprintf(os.Stderr, "Metadata driver %s is not persistent, refusing to check an empty store\n", config.Metadata.Driver)
+		return 2
+	}
+	s := store.NewProxyStore(metaStorage, fileStorage)
+	report := Scrub(s, *quarantine, log)
+	if err := store.Flush(s); err != nil {
+		log.Errorf("Could not flush store: %v", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if len(report.Issues) > 0 {
+		return 1
+	}
+	return 0
+}
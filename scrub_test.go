@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/blang/crane/auth"
+	"github.com/blang/crane/store"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestScrub(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "crane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	s := store.NewProxyStore(store.NewMemMetaStorage(), store.NewLocalFileStorage(dataDir, newTestLogger()))
+	r := NewRegistry(s, auth.NewLocalAuthenticator(), newTestLogger())
+
+	r.BeginPush("token", "user", "user", "repo", []string{"img1", "img2"})
+	pushTestImage(t, r, "token", "img1")
+	r.SetTmpAncestry("img2", "img1")
+	pushTestImage(t, r, "token", "img2")
+	r.PushTag("token", "user", "repo", "img1", "latest")
+	if err := r.FinishPush("user", "user", "repo"); err != nil {
+		t.Fatal(err)
+	}
+	if report := r.Scrub(true); len(report.Issues) != 0 || report.Images != 2 {
+		t.Fatalf("Issues in intact store: %+v", report)
+	}
+
+	layers, _ := filepath.Glob(path.Join(dataDir, "layers", "*", "*", "img1_layer"))
+	if len(layers) != 1 {
+		t.Fatalf("Layer file not found: %v", layers)
+	}
+	if err := ioutil.WriteFile(layers[0], []byte("bit rot of img1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	report := r.Scrub(false)
+	if len(report.Issues) != 1 || report.Issues[0].ImageID != "img1" || len(report.Quarantined) != 0 {
+		t.Errorf("Corruption not reported: %+v", report)
+	}
+
+	report = r.Scrub(true)
+	if len(report.Quarantined) != 1 || report.Quarantined[0] != "img1" {
+		t.Errorf("Image not quarantined: %+v", report)
+	}
+	if _, err := os.Stat(path.Join(dataDir, "quarantine", "img1_layer")); err != nil {
+		t.Errorf("Layer not moved to quarantine: %v", err)
+	}
+	if _, found := r.ImageJSON("img1"); found {
+		t.Error("Quarantined image still served")
+	}
+
+	// Now the parent of img2 and the tag are dangling
+	report = r.Scrub(false)
+	if last, _ := r.LastScrubReport(); last.Time != report.Time {
+		t.Error("Last report not kept")
+	}
+	if len(report.Issues) != 3 {
+		t.Errorf("Dangling references not reported: %+v", report.Issues)
+	}
+}
+
+func TestFsckCommand(t *testing.T) {
+	config, cleanup := writeFileStoreConfig(t)
+	defer cleanup()
+	r := NewRegistry(openConfigStore(t, config), auth.NewLocalAuthenticator(), newTestLogger())
+	pushTestImage(t, r, "", "img1")
+	r.SetImages("user", "repo", []string{"img1", "img2"})
+
+	stdout := os.Stdout
+	os.Stdout, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	defer func() { os.Stdout = stdout }()
+	if code := fsckCommand([]string{"-config", config}); code != 1 {
+		t.Errorf("Missing image not reported, exit code %d", code)
+	}
+	r.SetImages("user", "repo", []string{"img1"})
+	if code := fsckCommand([]string{"-config", config}); code != 0 {
+		t.Errorf("Issues in intact store, exit code %d", code)
+	}
+}
@@ -0,0 +1,272 @@
+package store
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+var (
+	errTooLargeToCache = errors.New("Too large to cache")
+	errImageNotFound   = errors.New("Image not found")
+)
+
+// CacheStats are the counters of a Cache
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// Cache is a least recently used cache bounded by the bytes of its entries.
+// Concurrent misses of the same key are loaded once.
+type Cache struct {
+	mu          sync.Mutex
+	maxBytes    int64
+	maxItemSize int64
+	entries     map[string]*list.Element
+	order       *list.List // front is the most recently used
+	flights     map[string]*flight
+	gen         uint64 // incremented on every invalidation, loads started before are not cached
+	stats       CacheStats
+}
+
+type cacheEntry struct {
+	key      string
+	value    []byte
+	tooLarge bool // remembers that the value is not cached, so it is not loaded on every get
+}
+
+// Bytes an entry is accounted with
+func (e *cacheEntry) size() int64 {
+	if e.tooLarge {
+		return int64(len(e.key))
+	}
+	return int64(len(e.value))
+}
+
+type flight struct {
+	done  chan struct{}
+	value []byte
+	err   error
+}
+
+// Creates a cache holding up to maxBytes, values larger than maxItemSize are not cached
+func NewCache(maxBytes int64, maxItemSize int64) *Cache {
+	if maxItemSize <= 0 || maxItemSize > maxBytes {
+		maxItemSize = maxBytes
+	}
+	return &Cache{
+		maxBytes:    maxBytes,
+		maxItemSize: maxItemSize,
+		entries:     make(map[string]*list.Element),
+		order:       list.New(),
+		flights:     make(map[string]*flight),
+	}
+}
+
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	return stats
+}
+
+// Returns the cached value of key or loads it with load, which is called once for concurrent misses.
+// Load returns errTooLargeToCache if the value exceeds the max item size.
+func (c *Cache) get(key string, load func(maxSize int64) ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	if elem, found := c.entries[key]; found {
+		c.order.MoveToFront(elem)
+		c.stats.Hits++
+		c.mu.Unlock()
+		entry := elem.Value.(*cacheEntry)
+		if entry.tooLarge {
+			return nil, errTooLargeToCache
+		}
+		return entry.value, nil
+	}
+	c.stats.Misses++
+	if f, found := c.flights[key]; found {
+		c.mu.Unlock()
+		<-f.done
+		return f.value, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	gen := c.gen
+	c.mu.Unlock()
+
+	f.value, f.err = load(c.maxItemSize)
+
+	c.mu.Lock()
+	delete(c.flights, key)
+	if gen == c.gen {
+		switch f.err {
+		case nil:
+			c.add(&cacheEntry{key: key, value: f.value})
+		case errTooLargeToCache:
+			c.add(&cacheEntry{key: key, tooLarge: true})
+		}
+	}
+	c.mu.Unlock()
+	close(f.done)
+	return f.value, f.err
+}
+
+// Adds value and evicts least recently used entries, c.mu must be held
+func (c *Cache) add(entry *cacheEntry) {
+	if !entry.tooLarge && entry.size() > c.maxItemSize {
+		return
+	}
+	if elem, found := c.entries[entry.key]; found {
+		c.removeElement(elem)
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.stats.Bytes += entry.size()
+	for c.stats.Bytes > c.maxBytes {
+		c.removeElement(c.order.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *Cache) removeElement(elem *list.Element) {
+	entry := c.order.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.stats.Bytes -= entry.size()
+}
+
+// Removes key, loads in flight are not cached
+func (c *Cache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if elem, found := c.entries[key]; found {
+		c.removeElement(elem)
+	}
+}
+
+// CachedFileStorage keeps small layers of the wrapped storage in a Cache
+type CachedFileStorage struct {
+	FileStorage
+	cache *Cache
+}
+
+func NewCachedFileStorage(files FileStorage, cache *Cache) *CachedFileStorage {
+	return &CachedFileStorage{
+		FileStorage: files,
+		cache:       cache,
+	}
+}
+
+// Returns the cached layer, layers larger than the max item size are read from the wrapped storage
+func (c *CachedFileStorage) Layer(imageID string) (ReadCloseSeeker, error) {
+	layer, err := c.cache.get("layer/"+imageID, func(maxSize int64) ([]byte, error) {
+		return c.readSmallLayer(imageID, maxSize)
+	})
+	if err == errTooLargeToCache {
+		return c.FileStorage.Layer(imageID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nopCloser{bytes.NewReader(layer)}, nil
+}
+
+// Reads the layer from the wrapped storage without adding it to the cache
+func (c *CachedFileStorage) UncachedLayer(imageID string) (ReadCloseSeeker, error) {
+	return UncachedLayer(c.FileStorage, imageID)
+}
+
+func (c *CachedFileStorage) readSmallLayer(imageID string, maxSize int64) ([]byte, error) {
+	layer, err := c.FileStorage.Layer(imageID)
+	if err != nil {
+		return nil, err
+	}
+	defer layer.Close()
+	size, err := layer.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxSize {
+		return nil, errTooLargeToCache
+	}
+	if _, err := layer.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(layer)
+}
+
+func (c *CachedFileStorage) CommitTmpLayer(imageID string) bool {
+	defer c.cache.invalidate("layer/" + imageID)
+	return c.FileStorage.CommitTmpLayer(imageID)
+}
+
+func (c *CachedFileStorage) DeleteLayer(imageID string) bool {
+	defer c.cache.invalidate("layer/" + imageID)
+	return c.FileStorage.DeleteLayer(imageID)
+}
+
+func (c *CachedFileStorage) Flush() error {
+	return Flush(c.FileStorage)
+}
+
+func (c *CachedFileStorage) LayerIDs() ([]string, error) {
+	return LayerIDs(c.FileStorage)
+}
+
+func (c *CachedFileStorage) QuarantineLayer(imageID string) error {
+	defer c.cache.invalidate("layer/" + imageID)
+	return QuarantineLayer(c.FileStorage, imageID)
+}
+
+// CachedMetaStorage keeps image JSON of the wrapped storage in a Cache
+type CachedMetaStorage struct {
+	MetaStorage
+	cache *Cache
+}
+
+func NewCachedMetaStorage(meta MetaStorage, cache *Cache) *CachedMetaStorage {
+	return &CachedMetaStorage{
+		MetaStorage: meta,
+		cache:       cache,
+	}
+}
+
+func (c *CachedMetaStorage) ImageJSON(imageID string) (string, bool) {
+	json, err := c.cache.get("json/"+imageID, func(maxSize int64) ([]byte, error) {
+		json, found := c.MetaStorage.ImageJSON(imageID)
+		if !found {
+			return nil, errImageNotFound
+		}
+		return []byte(json), nil
+	})
+	if err != nil {
+		return "", false
+	}
+	return string(json), true
+}
+
+func (c *CachedMetaStorage) CommitTmpImage(imageID string) bool {
+	defer c.cache.invalidate("json/" + imageID)
+	return c.MetaStorage.CommitTmpImage(imageID)
+}
+
+func (c *CachedMetaStorage) DeleteImage(imageID string) bool {
+	defer c.cache.invalidate("json/" + imageID)
+	return c.MetaStorage.DeleteImage(imageID)
+}
+
+func (c *CachedMetaStorage) Flush() error {
+	return Flush(c.MetaStorage)
+}
+
+func (c *CachedMetaStorage) Persistent() bool {
+	return IsPersistent(c.MetaStorage)
+}
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Counts layer reads of the wrapped storage
+type countingFileStorage struct {
+	FileStorage
+	reads int32
+}
+
+func (c *countingFileStorage) Layer(imageID string) (ReadCloseSeeker, error) {
+	atomic.AddInt32(&c.reads, 1)
+	time.Sleep(10 * time.Millisecond)
+	return c.FileStorage.Layer(imageID)
+}
+
+func storeLayer(t *testing.T, files FileStorage, imageID string, content string) {
+	if _, _, err := files.SetTmpLayer(imageID, "{}", ioutil.NopCloser(strings.NewReader(content))); err != nil {
+		t.Fatal(err)
+	}
+	if !files.CommitTmpLayer(imageID) {
+		t.Fatalf("Could not commit layer %s", imageID)
+	}
+}
+
+func readCachedLayer(t *testing.T, files FileStorage, imageID string) string {
+	layer, err := files.Layer(imageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer layer.Close()
+	b, _ := ioutil.ReadAll(layer)
+	return string(b)
+}
+
+func TestCachedFileStorage(t *testing.T) {
+	inner := &countingFileStorage{FileStorage: NewMemFileStorage()}
+	cache := NewCache(10, 5)
+	files := NewCachedFileStorage(inner, cache)
+	storeLayer(t, files, "a", "aaaa")
+	storeLayer(t, files, "b", "bbbb")
+	storeLayer(t, files, "c", "cccc")
+	storeLayer(t, files, "large", "large layer")
+
+	// Concurrent misses read the layer once
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if layer := readCachedLayer(t, files, "a"); layer != "aaaa" {
+				t.Errorf("Wrong layer: %q", layer)
+			}
+		}()
+	}
+	wg.Wait()
+	if inner.reads != 1 {
+		t.Errorf("Expected 1 read for concurrent misses, got %d", inner.reads)
+	}
+	readCachedLayer(t, files, "a")
+	if inner.reads != 1 || cache.Stats().Hits == 0 {
+		t.Errorf("Cached layer read again, %d reads, stats %+v", inner.reads, cache.Stats())
+	}
+
+	// Reading b and c evicts the least recently used a
+	readCachedLayer(t, files, "b")
+	readCachedLayer(t, files, "c")
+	if stats := cache.Stats(); stats.Bytes != 8 || stats.Entries != 2 || stats.Evictions != 1 {
+		t.Errorf("Wrong stats after eviction: %+v", stats)
+	}
+	inner.reads = 0
+	readCachedLayer(t, files, "a")
+	if inner.reads != 1 {
+		t.Errorf("Evicted layer not read again")
+	}
+
+	// Large layers are not cached, but known to be large
+	cache = NewCache(100, 5)
+	files = NewCachedFileStorage(inner, cache)
+	inner.reads = 0
+	for i := 0; i < 2; i++ {
+		if layer := readCachedLayer(t, files, "large"); layer != "large layer" {
+			t.Errorf("Wrong large layer: %q", layer)
+		}
+	}
+	if inner.reads != 3 {
+		t.Errorf("Expected 3 reads of the large layer, got %d", inner.reads)
+	}
+
+	// Replaced and deleted layers are invalidated
+	storeLayer(t, files, "a", "AAAA")
+	if layer := readCachedLayer(t, files, "a"); layer != "AAAA" {
+		t.Errorf("Stale layer after commit: %q", layer)
+	}
+	files.DeleteLayer("a")
+	if _, err := files.Layer("a"); err == nil {
+		t.Error("Deleted layer still cached")
+	}
+
+	// Uncached reads go to the wrapped storage and leave the cache alone
+	cache = NewCache(100, 5)
+	files = NewCachedFileStorage(inner, cache)
+	inner.reads = 0
+	for i := 0; i < 2; i++ {
+		layer, err := UncachedLayer(NewProxyStore(NewMemMetaStorage(), files), "b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		layer.Close()
+	}
+	if inner.reads != 2 || cache.Stats().Entries != 0 {
+		t.Errorf("Uncached reads used the cache, %d reads, stats %+v", inner.reads, cache.Stats())
+	}
+}
+
+func TestCachedMetaStorage(t *testing.T) {
+	cache := NewCache(100, 0)
+	meta := NewCachedMetaStorage(NewMemMetaStorage(), cache)
+	if _, found := meta.ImageJSON("img"); found {
+		t.Fatal("Unknown image found")
+	}
+	meta.SetTmpImageJSON("img", "{}")
+	meta.SetTmpChecksum("img", "checksum")
+	meta.SetTmpSize("img", 0)
+	if !meta.CommitTmpImage("img") {
+		t.Fatal("Could not commit image")
+	}
+	for i := 0; i < 2; i++ {
+		if json, found := meta.ImageJSON("img"); !found || json != "{}" {
+			t.Errorf("Wrong image json: %q", json)
+		}
+	}
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Entries != 1 {
+		t.Errorf("Image json not cached: %+v", stats)
+	}
+	meta.DeleteImage("img")
+	if _, found := meta.ImageJSON("img"); found {
+		t.Error("Deleted image json still cached")
+	}
+}
@@ -0,0 +1,367 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Chunk files store a stream as independently transformed chunks with an index,
+// so a reader can seek in the original stream by only transforming the chunks it reads.
+//
+// Layout:
+//
+//	header:  magic, codec name length (1 byte), codec name, params length (2 bytes), params, chunk size (4 bytes)
+//	chunks:  transformed chunks
+//	index:   per chunk offset (8 bytes) and transformed length (4 bytes)
+//	trailer: original size (8 bytes), chunk count (4 bytes), index offset (8 bytes), magic
+var chunkFileMagic = []byte("CRCF")
+
+const (
+	chunkFileTrailerSize = 8 + 4 + 8 + 4
+	defaultChunkSize     = 1 << 20
+)
+
+var (
+	ErrInvalidChunkFile = errors.New("Invalid chunk file")
+	ErrCodecUnavailable = errors.New("Layer is stored with a compression or encryption which is not configured")
+)
+
+// Codecs of the chunk files written by this package
+var knownChunkCodecs = map[string]bool{"gzip": true, "zstd": true, encryptionCodec: true}
+
+// Transforms single chunks, index is the position of the chunk in the stream and last marks the final chunk
+type chunkCodec interface {
+	Name() string
+	Params() []byte // stored in the header and passed to the codec lookup when reading
+	Seal(index uint32, last bool, chunk []byte) ([]byte, error)
+	Open(index uint32, last bool, sealed []byte) ([]byte, error)
+}
+
+// Returns the codec to read a chunk file written with the codec name and params
+type chunkCodecLookup func(name string, params []byte) (chunkCodec, error)
+
+type chunkEntry struct {
+	offset uint64
+	length uint32
+}
+
+type chunkWriter struct {
+	w         io.Writer
+	codec     chunkCodec
+	chunkSize int
+	buf       []byte
+	offset    uint64
+	size      uint64
+	index     []chunkEntry
+}
+
+func newChunkWriter(w io.Writer, codec chunkCodec, chunkSize int) (*chunkWriter, error) {
+	var header bytes.Buffer
+	header.Write(chunkFileMagic)
+	header.WriteByte(byte(len(codec.Name())))
+	header.WriteString(codec.Name())
+	binary.Write(&header, binary.BigEndian, uint16(len(codec.Params())))
+	header.Write(codec.Params())
+	binary.Write(&header, binary.BigEndian, uint32(chunkSize))
+	n, err := w.Write(header.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &chunkWriter{
+		w:         w,
+		codec:     codec,
+		chunkSize: chunkSize,
+		buf:       make([]byte, 0, chunkSize),
+		offset:    uint64(n),
+	}, nil
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := c.chunkSize - len(c.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		c.buf = append(c.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(c.buf) == c.chunkSize && len(p) > 0 {
+			if err := c.flushChunk(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (c *chunkWriter) flushChunk(last bool) error {
+	sealed, err := c.codec.Seal(uint32(len(c.index)), last, c.buf)
+	if err != nil {
+		return err
+	}
+	if _, err := c.w.Write(sealed); err != nil {
+		return err
+	}
+	c.index = append(c.index, chunkEntry{offset: c.offset, length: uint32(len(sealed))})
+	c.offset += uint64(len(sealed))
+	c.size += uint64(len(c.buf))
+	c.buf = c.buf[:0]
+	return nil
+}
+
+// Writes the last chunk, the index and the trailer, does not close the underlying writer
+func (c *chunkWriter) Close() error {
+	if len(c.buf) > 0 || len(c.index) == 0 {
+		if err := c.flushChunk(true); err != nil {
+			return err
+		}
+	}
+	var tail bytes.Buffer
+	for _, entry := range c.index {
+		binary.Write(&tail, binary.BigEndian, entry.offset)
+		binary.Write(&tail, binary.BigEndian, entry.length)
+	}
+	binary.Write(&tail, binary.BigEndian, c.size)
+	binary.Write(&tail, binary.BigEndian, uint32(len(c.index)))
+	binary.Write(&tail, binary.BigEndian, c.offset)
+	tail.Write(chunkFileMagic)
+	_, err := c.w.Write(tail.Bytes())
+	return err
+}
+
+// Reads the original stream of a chunk file and supports seeking
+type chunkReader struct {
+	r         ReadCloseSeeker
+	codec     chunkCodec
+	chunkSize int64
+	size      int64
+	index     []chunkEntry
+	pos       int64
+	cur       int // index of the cached chunk, -1 if none
+	chunk     []byte
+}
+
+// Checks for the header and trailer of a chunk file
+func isChunkFile(r io.ReadSeeker) bool {
+	magic := make([]byte, len(chunkFileMagic))
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return false
+	}
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, chunkFileMagic) {
+		return false
+	}
+	if _, err := r.Seek(-int64(len(chunkFileMagic)), io.SeekEnd); err != nil {
+		return false
+	}
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, chunkFileMagic) {
+		return false
+	}
+	return true
+}
+
+// Reads the codec name, codec params and chunk size from the header of a chunk file
+func readChunkHeader(r io.ReadSeeker) (string, []byte, uint32, error) {
+	if _, err := r.Seek(int64(len(chunkFileMagic)), io.SeekStart); err != nil {
+		return "", nil, 0, err
+	}
+	var nameLen [1]byte
+	if _, err := io.ReadFull(r, nameLen[:]); err != nil {
+		return "", nil, 0, err
+	}
+	name := make([]byte, nameLen[0])
+	if _, err := io.ReadFull(r, name); err != nil {
+		return "", nil, 0, err
+	}
+	var paramsLen uint16
+	if err := binary.Read(r, binary.BigEndian, &paramsLen); err != nil {
+		return "", nil, 0, err
+	}
+	params := make([]byte, paramsLen)
+	if _, err := io.ReadFull(r, params); err != nil {
+		return "", nil, 0, err
+	}
+	var chunkSize uint32
+	if err := binary.Read(r, binary.BigEndian, &chunkSize); err != nil {
+		return "", nil, 0, err
+	}
+	return string(name), params, chunkSize, nil
+}
+
+// Returns the codec name of a chunk file, or false if r is no chunk file
+func chunkFileCodec(r io.ReadSeeker) (string, bool) {
+	if !isChunkFile(r) {
+		return "", false
+	}
+	name, _, _, err := readChunkHeader(r)
+	return name, err == nil
+}
+
+// Checks that a layer returned as it is is no chunk file of a known codec,
+// so compressed or encrypted layers are never served if their codec is not configured.
+func checkRawLayer(layer io.ReadSeeker) error {
+	if name, found := chunkFileCodec(layer); found && knownChunkCodecs[name] {
+		return ErrCodecUnavailable
+	}
+	_, err := layer.Seek(0, io.SeekStart)
+	return err
+}
+
+// FileStorage refusing layers stored as chunk files, used if neither compression nor encryption is configured
+type rawFileStorage struct {
+	FileStorage
+}
+
+func (r rawFileStorage) Layer(imageID string) (ReadCloseSeeker, error) {
+	layer, err := r.FileStorage.Layer(imageID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRawLayer(layer); err != nil {
+		layer.Close()
+		return nil, err
+	}
+	return layer, nil
+}
+
+func (r rawFileStorage) Flush() error {
+	return Flush(r.FileStorage)
+}
+
+func (r rawFileStorage) LayerIDs() ([]string, error) {
+	return LayerIDs(r.FileStorage)
+}
+
+func (r rawFileStorage) QuarantineLayer(imageID string) error {
+	return QuarantineLayer(r.FileStorage, imageID)
+}
+
+func newChunkReader(r ReadCloseSeeker, lookup chunkCodecLookup) (*chunkReader, error) {
+	name, params, chunkSize, err := readChunkHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := lookup(name, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := r.Seek(-chunkFileTrailerSize, io.SeekEnd); err != nil {
+		return nil, err
+	}
+	var trailer struct {
+		Size        uint64
+		Count       uint32
+		IndexOffset uint64
+	}
+	if err := binary.Read(r, binary.BigEndian, &trailer); err != nil {
+		return nil, err
+	}
+	if chunkSize == 0 {
+		return nil, ErrInvalidChunkFile
+	}
+	// Empty streams have a single empty chunk
+	count := (trailer.Size + uint64(chunkSize) - 1) / uint64(chunkSize)
+	if count == 0 {
+		count = 1
+	}
+	if uint64(trailer.Count) != count {
+		return nil, ErrInvalidChunkFile
+	}
+	if _, err := r.Seek(int64(trailer.IndexOffset), io.SeekStart); err != nil {
+		return nil, err
+	}
+	index := make([]chunkEntry, trailer.Count)
+	for i := range index {
+		if err := binary.Read(r, binary.BigEndian, &index[i].offset); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.BigEndian, &index[i].length); err != nil {
+			return nil, err
+		}
+	}
+	reader := &chunkReader{
+		r:         r,
+		codec:     codec,
+		chunkSize: int64(chunkSize),
+		size:      int64(trailer.Size),
+		index:     index,
+		cur:       -1,
+	}
+	// The trailer is not authenticated, the length of the last chunk confirms the size
+	if err := reader.load(len(index) - 1); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+func (c *chunkReader) load(i int) error {
+	if i == c.cur {
+		return nil
+	}
+	entry := c.index[i]
+	if _, err := c.r.Seek(int64(entry.offset), io.SeekStart); err != nil {
+		return err
+	}
+	sealed := make([]byte, entry.length)
+	if _, err := io.ReadFull(c.r, sealed); err != nil {
+		return err
+	}
+	chunk, err := c.codec.Open(uint32(i), i == len(c.index)-1, sealed)
+	if err != nil {
+		return err
+	}
+	expected := c.chunkSize
+	if i == len(c.index)-1 {
+		expected = c.size - int64(i)*c.chunkSize
+	}
+	if int64(len(chunk)) != expected {
+		return ErrInvalidChunkFile
+	}
+	c.cur, c.chunk = i, chunk
+	return nil
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.pos >= c.size {
+		return 0, io.EOF
+	}
+	i := int(c.pos / c.chunkSize)
+	if err := c.load(i); err != nil {
+		return 0, err
+	}
+	start := c.pos - int64(i)*c.chunkSize
+	if start >= int64(len(c.chunk)) {
+		return 0, ErrInvalidChunkFile
+	}
+	end := int64(len(c.chunk))
+	if remaining := c.size - int64(i)*c.chunkSize; remaining < end {
+		end = remaining
+	}
+	n := copy(p, c.chunk[start:end])
+	c.pos += int64(n)
+	return n, nil
+}
+
+func (c *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += c.pos
+	case io.SeekEnd:
+		offset += c.size
+	default:
+		return 0, errors.New("Invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative position")
+	}
+	c.pos = offset
+	return offset, nil
+}
+
+func (c *chunkReader) Close() error {
+	return c.r.Close()
+}
@@ -0,0 +1,232 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+)
+
+// Compression policies
+const (
+	CompressAlways = "always"
+	CompressAuto   = "auto" // skip layers which are already compressed
+)
+
+// Magic numbers of gzip, bzip2, xz and zstd
+var compressedMagics = [][]byte{
+	{0x1f, 0x8b},
+	[]byte("BZh"),
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},
+	{0x28, 0xb5, 0x2f, 0xfd},
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string   { return "gzip" }
+func (gzipCodec) Params() []byte { return nil }
+
+func (gzipCodec) Seal(index uint32, last bool, chunk []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(chunk); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Open(index uint32, last bool, sealed []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(sealed))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type zstdCodec struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func newZstdCodec() (*zstdCodec, error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &zstdCodec{encoder: encoder, decoder: decoder}, nil
+}
+
+func (*zstdCodec) Name() string   { return "zstd" }
+func (*zstdCodec) Params() []byte { return nil }
+
+func (z *zstdCodec) Seal(index uint32, last bool, chunk []byte) ([]byte, error) {
+	return z.encoder.EncodeAll(chunk, nil), nil
+}
+
+func (z *zstdCodec) Open(index uint32, last bool, sealed []byte) ([]byte, error) {
+	return z.decoder.DecodeAll(sealed, nil)
+}
+
+// CompressedFileStorage compresses layers in seekable chunks before they are stored by the wrapped storage.
+// Layers stored without compression, like ones written before compression was enabled, are returned as they are,
+// unless they are chunk files of another codec, e.g. encrypted layers without encryption configured.
+type CompressedFileStorage struct {
+	FileStorage
+	codec     chunkCodec
+	codecs    map[string]chunkCodec
+	policy    string
+	chunkSize int
+}
+
+// Wraps files to compress layers with algorithm gzip or zstd following policy
+func NewCompressedFileStorage(files FileStorage, algorithm string, policy string) (*CompressedFileStorage, error) {
+	zstdCodec, err := newZstdCodec()
+	if err != nil {
+		return nil, err
+	}
+	c := &CompressedFileStorage{
+		FileStorage: files,
+		codecs:      map[string]chunkCodec{"gzip": gzipCodec{}, "zstd": zstdCodec},
+		policy:      policy,
+		chunkSize:   defaultChunkSize,
+	}
+	codec, found := c.codecs[algorithm]
+	if !found {
+		return nil, errors.New("Unknown compression " + algorithm)
+	}
+	c.codec = codec
+	switch policy {
+	case CompressAlways, CompressAuto:
+	default:
+		return nil, errors.New("Unknown compression policy " + policy)
+	}
+	return c, nil
+}
+
+// Applies the compression and compression_policy driver options to files, compression defaults to none.
+// Without compression, layers which are still chunk files after decryption are refused.
+func withCompression(files FileStorage, options map[string]string) (FileStorage, error) {
+	algorithm := options["compression"]
+	if algorithm == "" || algorithm == "none" {
+		return rawFileStorage{files}, nil
+	}
+	policy := options["compression_policy"]
+	if policy == "" {
+		policy = CompressAuto
+	}
+	return NewCompressedFileStorage(files, algorithm, policy)
+}
+
+func (c *CompressedFileStorage) lookup(name string, params []byte) (chunkCodec, error) {
+	codec, found := c.codecs[name]
+	if !found {
+		return nil, errors.New("Unknown compression " + name)
+	}
+	return codec, nil
+}
+
+// Returns the uncompressed layer
+func (c *CompressedFileStorage) Layer(imageID string) (ReadCloseSeeker, error) {
+	layer, err := c.FileStorage.Layer(imageID)
+	if err != nil {
+		return nil, err
+	}
+	if name, found := chunkFileCodec(layer); !found || c.codecs[name] == nil {
+		if err := checkRawLayer(layer); err != nil {
+			layer.Close()
+			return nil, err
+		}
+		return layer, nil
+	}
+	reader, err := newChunkReader(layer, c.lookup)
+	if err != nil {
+		layer.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// Stores the compressed layer, checksum and size are calculated on the uncompressed data
+func (c *CompressedFileStorage) SetTmpLayer(imageID string, imageJSON string, r io.ReadCloser) (string, int64, error) {
+	defer r.Close()
+	hash := sha256.New()
+	hash.Write([]byte(imageJSON + "\n"))
+	counter := &countingReader{Reader: io.TeeReader(r, hash)}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(c.compress(pw, counter))
+	}()
+	if _, _, err := c.FileStorage.SetTmpLayer(imageID, imageJSON, pr); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), counter.n, nil
+}
+
+func (c *CompressedFileStorage) compress(w io.Writer, r io.Reader) error {
+	if c.policy == CompressAuto {
+		head := make([]byte, 8)
+		n, err := io.ReadFull(r, head)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		head = head[:n]
+		r = io.MultiReader(bytes.NewReader(head), r)
+		if isCompressed(head) {
+			_, err := io.Copy(w, r)
+			return err
+		}
+	}
+	cw, err := newChunkWriter(w, c.codec, c.chunkSize)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(cw, r); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+func isCompressed(head []byte) bool {
+	for _, magic := range compressedMagics {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CompressedFileStorage) Flush() error {
+	return Flush(c.FileStorage)
+}
+
+func (c *CompressedFileStorage) LayerIDs() ([]string, error) {
+	return LayerIDs(c.FileStorage)
+}
+
+func (c *CompressedFileStorage) QuarantineLayer(imageID string) error {
+	return QuarantineLayer(c.FileStorage, imageID)
+}
+
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
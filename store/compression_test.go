@@ -0,0 +1,91 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func storedSize(t *testing.T, files FileStorage, imageID string) int {
+	layer, err := files.Layer(imageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer layer.Close()
+	b, _ := ioutil.ReadAll(layer)
+	return len(b)
+}
+
+func TestCompressedFileStorage(t *testing.T) {
+	content := []byte(strings.Repeat("uncompressed tar layer ", 500))
+	for _, algorithm := range []string{"gzip", "zstd"} {
+		mem := NewMemFileStorage()
+		files, err := NewCompressedFileStorage(mem, algorithm, CompressAuto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files.chunkSize = 1000
+
+		checksum, size, err := files.SetTmpLayer("img", "{}", ioutil.NopCloser(bytes.NewReader(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash := sha256.Sum256(append([]byte("{}\n"), content...))
+		if checksum != hex.EncodeToString(hash[:]) || size != int64(len(content)) {
+			t.Errorf("%s: checksum or size not of the uncompressed layer: %s %d", algorithm, checksum, size)
+		}
+		files.CommitTmpLayer("img")
+		if stored := storedSize(t, mem, "img"); stored >= len(content)/2 {
+			t.Errorf("%s: layer not compressed: %d bytes", algorithm, stored)
+		}
+
+		layer, err := files.Layer("img")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if end, _ := layer.Seek(0, io.SeekEnd); end != int64(len(content)) {
+			t.Errorf("%s: wrong size %d", algorithm, end)
+		}
+		for i := 0; i < 20; i++ {
+			offset := rand.Int63n(int64(len(content)))
+			layer.Seek(offset, io.SeekStart)
+			buf := make([]byte, 1500)
+			n, _ := io.ReadFull(layer, buf)
+			if !bytes.Equal(buf[:n], content[offset:offset+int64(n)]) {
+				t.Fatalf("%s: wrong content at %d", algorithm, offset)
+			}
+		}
+		layer.Close()
+	}
+}
+
+func TestCompressionPolicy(t *testing.T) {
+	mem := NewMemFileStorage()
+	gzipped := append([]byte{0x1f, 0x8b}, []byte(strings.Repeat("a", 1000))...)
+	mem.SetTmpLayer("legacy", "{}", ioutil.NopCloser(bytes.NewReader(gzipped)))
+	mem.CommitTmpLayer("legacy")
+
+	files, err := NewCompressedFileStorage(mem, "gzip", CompressAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files.SetTmpLayer("compressed", "{}", ioutil.NopCloser(bytes.NewReader(gzipped)))
+	files.CommitTmpLayer("compressed")
+	if stored := storedSize(t, mem, "compressed"); stored != len(gzipped) {
+		t.Errorf("Already compressed layer compressed again: %d bytes", stored)
+	}
+	for _, imageID := range []string{"legacy", "compressed"} {
+		if size := storedSize(t, files, imageID); size != len(gzipped) {
+			t.Errorf("Uncompressed layer %s not readable: %d bytes", imageID, size)
+		}
+	}
+
+	if _, err := NewCompressedFileStorage(mem, "lz4", CompressAuto); err == nil {
+		t.Error("Unknown compression accepted")
+	}
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+)
+
+var ErrUnknownDriver = errors.New("Unknown storage driver")
+
+// Creates a meta storage from driver specific options
+type MetaStorageFactory func(options map[string]string, logger logrus.FieldLogger) (MetaStorage, error)
+
+// Creates a file storage from driver specific options
+type FileStorageFactory func(options map[string]string, logger logrus.FieldLogger) (FileStorage, error)
+
+var (
+	driversMu          sync.RWMutex
+	metaStorageDrivers = make(map[string]MetaStorageFactory)
+	fileStorageDrivers = make(map[string]FileStorageFactory)
+)
+
+// Makes a meta storage available by name, panics if the name is already registered.
+// Drivers usually register in init.
+func RegisterMetaStorage(name string, factory MetaStorageFactory) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if _, found := metaStorageDrivers[name]; found {
+		panic("store: meta storage driver registered twice: " + name)
+	}
+	metaStorageDrivers[name] = factory
+}
+
+// Makes a file storage available by name, panics if the name is already registered.
+// Drivers usually register in init.
+func RegisterFileStorage(name string, factory FileStorageFactory) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if _, found := fileStorageDrivers[name]; found {
+		panic("store: file storage driver registered twice: " + name)
+	}
+	fileStorageDrivers[name] = factory
+}
+
+// Creates a meta storage using the driver registered as name
+func NewMetaStorage(name string, options map[string]string, logger logrus.FieldLogger) (MetaStorage, error) {
+	driversMu.RLock()
+	factory, found := metaStorageDrivers[name]
+	driversMu.RUnlock()
+	if !found {
+		return nil, ErrUnknownDriver
+	}
+	return factory(options, logger)
+}
+
+// Creates a file storage using the driver registered as name
+func NewFileStorage(name string, options map[string]string, logger logrus.FieldLogger) (FileStorage, error) {
+	driversMu.RLock()
+	factory, found := fileStorageDrivers[name]
+	driversMu.RUnlock()
+	if !found {
+		return nil, ErrUnknownDriver
+	}
+	return factory(options, logger)
+}
+
+// Returns the sorted names of all registered meta storage drivers
+func MetaStorageDrivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	var names []string
+	for name := range metaStorageDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the sorted names of all registered file storage drivers
+func FileStorageDrivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	var names []string
+	for name := range fileStorageDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
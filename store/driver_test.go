@@ -0,0 +1,48 @@
+package store
+
+import (
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestDriverRegistry(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	if _, err := NewFileStorage("unknown", nil, logger); err != ErrUnknownDriver {
+		t.Errorf("Unknown driver not rejected: %v", err)
+	}
+	if _, err := NewFileStorage("local", nil, logger); err == nil {
+		t.Error("Local driver without datadir accepted")
+	}
+	if _, err := NewMetaStorage("memory", nil, logger); err != nil {
+		t.Error(err)
+	}
+
+	files, err := NewFileStorage("memory", nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, size, err := files.SetTmpLayer("img", "{}", ioutil.NopCloser(strings.NewReader("layer"))); err != nil || size != 5 {
+		t.Fatalf("Could not store layer: %d %v", size, err)
+	}
+	if !files.CommitTmpLayer("img") {
+		t.Fatal("Could not commit layer")
+	}
+	layer, err := files.Layer("img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(layer)
+	if string(b) != "layer" {
+		t.Errorf("Wrong layer: %q", b)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Duplicate driver registered")
+		}
+	}()
+	RegisterFileStorage("memory", nil)
+}
@@ -0,0 +1,336 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const encryptionCodec = "aes-256-gcm"
+
+var (
+	ErrUnknownKey   = errors.New("Unknown encryption key")
+	ErrNotEncrypted = errors.New("Layer is not encrypted")
+)
+
+// Keyring holds AES-256 keys by id, new data is encrypted with the active key
+type Keyring struct {
+	keys   map[string][]byte
+	active string
+}
+
+// Reads a keyfile with one "<key id> <base64 encoded 32 byte key>" line per key.
+// Empty lines and lines starting with # are ignored. The last key is the active key,
+// so a key is rotated by appending a new one; old keys must stay as long as data encrypted with them exists.
+func LoadKeyring(filename string) (*Keyring, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keyring := &Keyring{keys: make(map[string][]byte)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key id and key", filename, line)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s:%d: key must be 32 base64 encoded bytes", filename, line)
+		}
+		if _, found := keyring.keys[fields[0]]; found {
+			return nil, fmt.Errorf("%s:%d: duplicate key id %s", filename, line, fields[0])
+		}
+		keyring.keys[fields[0]] = key
+		keyring.active = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if keyring.active == "" {
+		return nil, errors.New("No keys in " + filename)
+	}
+	return keyring, nil
+}
+
+// Encrypts records which are read and written as a whole, like metadata files.
+// Persistent meta storage drivers must seal everything they write with the cipher of NewRecordCipher,
+// so metadata is encrypted at rest like layers.
+type RecordCipher interface {
+	Seal(record []byte) ([]byte, error)
+	Open(sealed []byte) ([]byte, error)
+}
+
+// Magic of sealed records, followed by the key id length (1 byte), the key id, the nonce and the ciphertext
+var sealedRecordMagic = []byte("CRER")
+
+// Returns the cipher for the encryption_keyfile driver option, records are stored as they are without it
+func NewRecordCipher(options map[string]string) (RecordCipher, error) {
+	keyfile := options["encryption_keyfile"]
+	if keyfile == "" {
+		return plainRecords{}, nil
+	}
+	return LoadKeyring(keyfile)
+}
+
+// Seals record with the active key, the header is authenticated as additional data
+func (k *Keyring) Seal(record []byte) ([]byte, error) {
+	aead, err := newRecordAEAD(k.keys[k.active])
+	if err != nil {
+		return nil, err
+	}
+	header := append(append(append([]byte(nil), sealedRecordMagic...), byte(len(k.active))), k.active...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(append(header, nonce...), nonce, record, header), nil
+}
+
+// Opens a record sealed with any key of the keyring.
+// Records written before encryption was enabled are returned as they are and sealed when written again.
+func (k *Keyring) Open(sealed []byte) ([]byte, error) {
+	if !bytes.HasPrefix(sealed, sealedRecordMagic) {
+		return sealed, nil
+	}
+	if len(sealed) <= len(sealedRecordMagic) {
+		return nil, ErrInvalidChunkFile
+	}
+	headerLen := len(sealedRecordMagic) + 1 + int(sealed[len(sealedRecordMagic)])
+	if len(sealed) < headerLen {
+		return nil, ErrInvalidChunkFile
+	}
+	key, found := k.keys[string(sealed[len(sealedRecordMagic)+1:headerLen])]
+	if !found {
+		return nil, ErrUnknownKey
+	}
+	aead, err := newRecordAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < headerLen+aead.NonceSize() {
+		return nil, ErrInvalidChunkFile
+	}
+	nonce := sealed[headerLen : headerLen+aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[headerLen+aead.NonceSize():], sealed[:headerLen])
+}
+
+func newRecordAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Stores records as they are, but refuses sealed records instead of returning ciphertext
+type plainRecords struct{}
+
+func (plainRecords) Seal(record []byte) ([]byte, error) {
+	return record, nil
+}
+
+func (plainRecords) Open(record []byte) ([]byte, error) {
+	if bytes.HasPrefix(record, sealedRecordMagic) {
+		return nil, ErrCodecUnavailable
+	}
+	return record, nil
+}
+
+// Encrypts chunks of a single layer file with AES-GCM.
+// The additional data binds each chunk to its image, file, position and whether it is the last one,
+// so chunks or whole files can not be swapped, reordered or truncated unnoticed.
+type gcmCodec struct {
+	keyID   string
+	fileID  []byte
+	imageID string
+	aead    cipher.AEAD
+}
+
+func newGCMCodec(keyID string, key []byte, fileID []byte, imageID string) (*gcmCodec, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmCodec{keyID: keyID, fileID: fileID, imageID: imageID, aead: aead}, nil
+}
+
+func (*gcmCodec) Name() string {
+	return encryptionCodec
+}
+
+// File id followed by the key id
+func (g *gcmCodec) Params() []byte {
+	return append(append([]byte(nil), g.fileID...), g.keyID...)
+}
+
+// File id, chunk index, last flag and image id
+func (g *gcmCodec) additionalData(index uint32, last bool) []byte {
+	ad := make([]byte, len(g.fileID)+5, len(g.fileID)+5+len(g.imageID))
+	copy(ad, g.fileID)
+	binary.BigEndian.PutUint32(ad[len(g.fileID):], index)
+	if last {
+		ad[len(ad)-1] = 1
+	}
+	return append(ad, g.imageID...)
+}
+
+// Returns the random nonce followed by the ciphertext
+func (g *gcmCodec) Seal(index uint32, last bool, chunk []byte) ([]byte, error) {
+	nonce := make([]byte, g.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return g.aead.Seal(nonce, nonce, chunk, g.additionalData(index, last)), nil
+}
+
+func (g *gcmCodec) Open(index uint32, last bool, sealed []byte) ([]byte, error) {
+	if len(sealed) < g.aead.NonceSize() {
+		return nil, ErrInvalidChunkFile
+	}
+	nonce := sealed[:g.aead.NonceSize()]
+	return g.aead.Open(nil, nonce, sealed[g.aead.NonceSize():], g.additionalData(index, last))
+}
+
+// EncryptedFileStorage encrypts layers in seekable chunks before they are stored by the wrapped storage.
+// Layers written before encryption was enabled are returned as they are, unless Strict is set.
+// Migrating to a storage with encryption enabled encrypts them.
+type EncryptedFileStorage struct {
+	FileStorage
+	keyring   *Keyring
+	chunkSize int
+	Strict    bool // refuse layers which are not encrypted, so substituted layer files are never served
+}
+
+func NewEncryptedFileStorage(files FileStorage, keyring *Keyring) *EncryptedFileStorage {
+	return &EncryptedFileStorage{
+		FileStorage: files,
+		keyring:     keyring,
+		chunkSize:   defaultChunkSize,
+	}
+}
+
+// Applies the encryption_keyfile and encryption_strict driver options to files
+func withEncryption(files FileStorage, options map[string]string) (FileStorage, error) {
+	keyfile := options["encryption_keyfile"]
+	if keyfile == "" {
+		return files, nil
+	}
+	keyring, err := LoadKeyring(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	encrypted := NewEncryptedFileStorage(files, keyring)
+	switch options["encryption_strict"] {
+	case "", "false":
+	case "true":
+		encrypted.Strict = true
+	default:
+		return nil, errors.New("Option encryption_strict must be true or false")
+	}
+	return encrypted, nil
+}
+
+// Returns the lookup for the codec of the layer of imageID
+func (e *EncryptedFileStorage) lookup(imageID string) chunkCodecLookup {
+	return func(name string, params []byte) (chunkCodec, error) {
+		if name != encryptionCodec || len(params) < 16 {
+			return nil, ErrInvalidChunkFile
+		}
+		keyID := string(params[16:])
+		key, found := e.keyring.keys[keyID]
+		if !found {
+			return nil, ErrUnknownKey
+		}
+		return newGCMCodec(keyID, key, params[:16], imageID)
+	}
+}
+
+// Returns the decrypted layer
+func (e *EncryptedFileStorage) Layer(imageID string) (ReadCloseSeeker, error) {
+	layer, err := e.FileStorage.Layer(imageID)
+	if err != nil {
+		return nil, err
+	}
+	if name, found := chunkFileCodec(layer); !found || name != encryptionCodec {
+		if e.Strict {
+			layer.Close()
+			return nil, ErrNotEncrypted
+		}
+		if _, err := layer.Seek(0, io.SeekStart); err != nil {
+			layer.Close()
+			return nil, err
+		}
+		return layer, nil
+	}
+	reader, err := newChunkReader(layer, e.lookup(imageID))
+	if err != nil {
+		layer.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// Stores the encrypted layer, checksum and size are calculated on the plaintext
+func (e *EncryptedFileStorage) SetTmpLayer(imageID string, imageJSON string, r io.ReadCloser) (string, int64, error) {
+	defer r.Close()
+	fileID := make([]byte, 16)
+	if _, err := rand.Read(fileID); err != nil {
+		return "", 0, err
+	}
+	codec, err := newGCMCodec(e.keyring.active, e.keyring.keys[e.keyring.active], fileID, imageID)
+	if err != nil {
+		return "", 0, err
+	}
+	hash := sha256.New()
+	hash.Write([]byte(imageJSON + "\n"))
+	counter := &countingReader{Reader: io.TeeReader(r, hash)}
+
+	pr, pw := io.Pipe()
+	go func() {
+		cw, err := newChunkWriter(pw, codec, e.chunkSize)
+		if err == nil {
+			_, err = io.Copy(cw, counter)
+		}
+		if err == nil {
+			err = cw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	if _, _, err := e.FileStorage.SetTmpLayer(imageID, imageJSON, pr); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), counter.n, nil
+}
+
+func (e *EncryptedFileStorage) Flush() error {
+	return Flush(e.FileStorage)
+}
+
+func (e *EncryptedFileStorage) LayerIDs() ([]string, error) {
+	return LayerIDs(e.FileStorage)
+}
+
+func (e *EncryptedFileStorage) QuarantineLayer(imageID string) error {
+	return QuarantineLayer(e.FileStorage, imageID)
+}
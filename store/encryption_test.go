@@ -0,0 +1,211 @@
+package store
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func writeKeyfile(t *testing.T, f *os.File, keyID string) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	f.WriteString(keyID + " " + base64.StdEncoding.EncodeToString(key) + "\n")
+}
+
+func TestEncryptedFileStorage(t *testing.T) {
+	f, err := ioutil.TempFile("", "crane-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# layer keys\n")
+	writeKeyfile(t, f, "key1")
+	keyring, err := LoadKeyring(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := NewMemFileStorage()
+	files := NewEncryptedFileStorage(mem, keyring)
+	files.chunkSize = 100
+	content := []byte(strings.Repeat("secret layer ", 100))
+	if _, size, err := files.SetTmpLayer("old", "{}", ioutil.NopCloser(bytes.NewReader(content))); err != nil || size != int64(len(content)) {
+		t.Fatalf("Could not store layer: %d %v", size, err)
+	}
+	files.CommitTmpLayer("old")
+	stored, _ := mem.Layer("old")
+	ciphertext, _ := ioutil.ReadAll(stored)
+	if bytes.Contains(ciphertext, []byte("secret")) {
+		t.Error("Layer stored in plaintext")
+	}
+
+	// Rotation: new layers use the new key, old layers stay readable
+	writeKeyfile(t, f, "key2")
+	keyring, err = LoadKeyring(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = NewEncryptedFileStorage(mem, keyring)
+	files.SetTmpLayer("new", "{}", ioutil.NopCloser(bytes.NewReader(content)))
+	files.CommitTmpLayer("new")
+	for _, imageID := range []string{"old", "new"} {
+		layer, err := files.Layer(imageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layer.Seek(250, io.SeekStart)
+		b, _ := ioutil.ReadAll(layer)
+		if !bytes.Equal(b, content[250:]) {
+			t.Errorf("Layer %s not decrypted", imageID)
+		}
+	}
+	stored, _ = mem.Layer("new")
+	name, params, _, _ := readChunkHeader(stored)
+	if name != encryptionCodec || string(params[16:]) != "key2" {
+		t.Errorf("New layer not encrypted with the active key: %s %q", name, params)
+	}
+
+	// Tampered chunks fail authentication
+	tampered := append([]byte(nil), ciphertext...)
+	tampered[100] ^= 1
+	mem.SetTmpLayer("tampered", "{}", ioutil.NopCloser(bytes.NewReader(tampered)))
+	mem.CommitTmpLayer("tampered")
+	if layer, err := files.Layer("tampered"); err == nil {
+		if _, err := ioutil.ReadAll(layer); err == nil {
+			t.Error("Tampered layer decrypted")
+		}
+	}
+
+	// The encrypted file of another layer is refused
+	mem.SetTmpLayer("swapped", "{}", ioutil.NopCloser(bytes.NewReader(ciphertext)))
+	mem.CommitTmpLayer("swapped")
+	if _, err := files.Layer("swapped"); err == nil {
+		t.Error("Layer of another image decrypted")
+	}
+
+	// A smaller size in the trailer is detected
+	truncated := append([]byte(nil), ciphertext...)
+	binary.BigEndian.PutUint64(truncated[len(truncated)-chunkFileTrailerSize:], uint64(len(content)-30))
+	mem.SetTmpLayer("old", "{}", ioutil.NopCloser(bytes.NewReader(truncated)))
+	mem.CommitTmpLayer("old")
+	if _, err := files.Layer("old"); err != ErrInvalidChunkFile {
+		t.Errorf("Layer with modified size opened: %v", err)
+	}
+}
+
+func TestCompressedEncryptedFileStorage(t *testing.T) {
+	f, err := ioutil.TempFile("", "crane-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	writeKeyfile(t, f, "key1")
+
+	mem := NewMemFileStorage()
+	options := map[string]string{"compression": "zstd", "encryption_keyfile": f.Name()}
+	encrypted, err := withEncryption(mem, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := withCompression(encrypted, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte(strings.Repeat("compressible ", 10000))
+	files.SetTmpLayer("img", "{}", ioutil.NopCloser(bytes.NewReader(content)))
+	files.CommitTmpLayer("img")
+	if stored := storedSize(t, mem, "img"); stored >= len(content)/10 {
+		t.Errorf("Layer not compressed before encryption: %d bytes", stored)
+	}
+	if size := storedSize(t, files, "img"); size != len(content) {
+		t.Errorf("Wrong layer size: %d", size)
+	}
+}
+
+func TestEncryptedLayerWithoutKey(t *testing.T) {
+	f, err := ioutil.TempFile("", "crane-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	writeKeyfile(t, f, "key1")
+
+	mem := NewMemFileStorage()
+	mem.SetTmpLayer("plain", "{}", ioutil.NopCloser(strings.NewReader("plain layer")))
+	mem.CommitTmpLayer("plain")
+	encrypted, err := withEncryption(mem, map[string]string{"encryption_keyfile": f.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted.SetTmpLayer("img", "{}", ioutil.NopCloser(strings.NewReader("secret layer")))
+	encrypted.CommitTmpLayer("img")
+
+	// Ciphertext is never served if encryption is not configured
+	for _, compression := range []string{"none", "gzip"} {
+		files, err := withCompression(mem, map[string]string{"compression": compression})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := files.Layer("img"); err != ErrCodecUnavailable {
+			t.Errorf("Encrypted layer served with compression %s: %v", compression, err)
+		}
+		if layer := readCachedLayer(t, files, "plain"); layer != "plain layer" {
+			t.Errorf("Wrong plain layer with compression %s: %q", compression, layer)
+		}
+	}
+
+	// Strict mode refuses layers which are not encrypted
+	strict, err := withEncryption(mem, map[string]string{"encryption_keyfile": f.Name(), "encryption_strict": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := strict.Layer("plain"); err != ErrNotEncrypted {
+		t.Errorf("Plain layer served in strict mode: %v", err)
+	}
+	if layer := readCachedLayer(t, strict, "img"); layer != "secret layer" {
+		t.Errorf("Wrong decrypted layer: %q", layer)
+	}
+}
+
+func TestRecordCipher(t *testing.T) {
+	f, err := ioutil.TempFile("", "crane-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	writeKeyfile(t, f, "key1")
+
+	records, err := NewRecordCipher(map[string]string{"encryption_keyfile": f.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := records.Seal([]byte("secret record"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("secret")) {
+		t.Error("Record stored in plaintext")
+	}
+	if record, err := records.Open(sealed); err != nil || string(record) != "secret record" {
+		t.Errorf("Wrong opened record: %q %v", record, err)
+	}
+	if record, err := records.Open([]byte("old record")); err != nil || string(record) != "old record" {
+		t.Errorf("Record written before encryption not returned: %q %v", record, err)
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := records.Open(sealed); err == nil {
+		t.Error("Tampered record opened")
+	}
+
+	// Sealed records are refused without the key
+	plain, _ := NewRecordCipher(map[string]string{})
+	if _, err := plain.Open(sealed); err != ErrCodecUnavailable {
+		t.Errorf("Sealed record opened without key: %v", err)
+	}
+}
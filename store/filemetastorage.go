@@ -0,0 +1,252 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options: datadir and encryption_keyfile. The metadata is written to metadata/metadata.json below datadir,
+// sealed with the cipher of NewRecordCipher.
+func init() {
+	RegisterMetaStorage("file", func(options map[string]string, logger logrus.FieldLogger) (MetaStorage, error) {
+		dataDir := options["datadir"]
+		if dataDir == "" {
+			return nil, errors.New("Option datadir missing")
+		}
+		cipher, err := NewRecordCipher(options)
+		if err != nil {
+			return nil, err
+		}
+		return NewFileMetaStorage(path.Join(dataDir, "metadata"), cipher, logger)
+	})
+}
+
+const metaSnapshotFile = "metadata.json"
+
+// FileMetaStorage keeps the metadata in memory like MemMetaStorage and writes a snapshot of the committed
+// metadata after every change. The snapshot is synced before it replaces the previous one,
+// so a change survives a crash once it returned. Metadata of uploads in progress is not written,
+// those can not complete after a restart anyway.
+type FileMetaStorage struct {
+	*MemMetaStorage
+	fs     fileSystem
+	dir    string
+	cipher RecordCipher
+	log    logrus.FieldLogger
+	saveMu sync.Mutex // serializes snapshot writes
+}
+
+type metaSnapshot struct {
+	Images       map[string]imageRecord `json:"images"`
+	Repositories map[string]*Repository `json:"repositories"`
+}
+
+type imageRecord struct {
+	JSON      string    `json:"json"`
+	Checksum  string    `json:"checksum"`
+	Size      int64     `json:"size"`
+	Committed time.Time `json:"committed"`
+	Parent    string    `json:"parent,omitempty"`
+}
+
+// Loads the snapshot in dir if there is one
+func NewFileMetaStorage(dir string, cipher RecordCipher, logger logrus.FieldLogger) (*FileMetaStorage, error) {
+	f := &FileMetaStorage{
+		MemMetaStorage: NewMemMetaStorage(),
+		fs:             osFS{},
+		dir:            dir,
+		cipher:         cipher,
+		log:            logger,
+	}
+	if err := f.fs.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileMetaStorage) load() error {
+	// Snapshots interrupted by a crash
+	names, err := f.fs.ReadDir(f.dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, ".tmp") {
+			f.fs.Remove(path.Join(f.dir, name))
+		}
+	}
+
+	file, err := f.fs.OpenFile(path.Join(f.dir, metaSnapshotFile), os.O_RDONLY, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	sealed, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	b, err := f.cipher.Open(sealed)
+	if err != nil {
+		return err
+	}
+	var snapshot metaSnapshot
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return err
+	}
+
+	m := f.MemMetaStorage
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Images are restored in any order, chains of parents restored later are completed like on commit
+	for imageID, image := range snapshot.Images {
+		m.imageJsonMap[imageID] = image.JSON
+		m.imageChecksumMap[imageID] = image.Checksum
+		m.imageSizeMap[imageID] = image.Size
+		m.imageCommittedMap[imageID] = image.Committed
+		m.imageAncestryMap[imageID] = m.materializeAncestry(imageID, image.Size, image.Parent, image.Parent != "")
+		m.completeAncestries(imageID)
+	}
+	for name, repo := range snapshot.Repositories {
+		if repo.Tags == nil {
+			repo.Tags = make(map[string]string)
+		}
+		if repo.TagHistory == nil {
+			repo.TagHistory = make(map[string][]TagHistoryEntry)
+		}
+		m.repositoryMap[name] = repo
+	}
+	return nil
+}
+
+// Encodes the committed metadata
+func (f *FileMetaStorage) marshal() ([]byte, error) {
+	m := f.MemMetaStorage
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	snapshot := metaSnapshot{
+		Images:       make(map[string]imageRecord, len(m.imageJsonMap)),
+		Repositories: m.repositoryMap,
+	}
+	for imageID, imageJSON := range m.imageJsonMap {
+		image := imageRecord{
+			JSON:      imageJSON,
+			Checksum:  m.imageChecksumMap[imageID],
+			Size:      m.imageSizeMap[imageID],
+			Committed: m.imageCommittedMap[imageID],
+		}
+		if chain := m.imageAncestryMap[imageID]; chain != nil && len(chain.imageIDs) > 1 {
+			image.Parent = chain.imageIDs[1]
+		}
+		snapshot.Images[imageID] = image
+	}
+	return json.Marshal(snapshot)
+}
+
+// Replaces the snapshot with the current metadata
+func (f *FileMetaStorage) save() error {
+	f.saveMu.Lock()
+	defer f.saveMu.Unlock()
+	b, err := f.marshal()
+	if err != nil {
+		return err
+	}
+	sealed, err := f.cipher.Seal(b)
+	if err != nil {
+		return err
+	}
+	w, err := f.fs.CreateTemp(f.dir, metaSnapshotFile+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(sealed)
+	if err == nil {
+		err = w.Sync()
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = f.fs.Rename(w.Name(), path.Join(f.dir, metaSnapshotFile))
+	}
+	if err != nil {
+		f.fs.Remove(w.Name())
+		return err
+	}
+	return f.fs.SyncDir(f.dir)
+}
+
+// Saves after a change reported by a bool, a failed save is logged and fails the change
+func (f *FileMetaStorage) saveChanged(changed bool) bool {
+	if !changed {
+		return false
+	}
+	if err := f.save(); err != nil {
+		f.log.Errorf("Could not write metadata: %v", err)
+		return false
+	}
+	return true
+}
+
+func (f *FileMetaStorage) CommitTmpImage(imageID string) bool {
+	return f.saveChanged(f.MemMetaStorage.CommitTmpImage(imageID))
+}
+
+func (f *FileMetaStorage) DeleteImage(imageID string) bool {
+	return f.saveChanged(f.MemMetaStorage.DeleteImage(imageID))
+}
+
+func (f *FileMetaStorage) SetTag(namespace string, repository string, imageID string, tag string) error {
+	if err := f.MemMetaStorage.SetTag(namespace, repository, imageID, tag); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileMetaStorage) DeleteTag(namespace string, repository string, tag string) error {
+	if err := f.MemMetaStorage.DeleteTag(namespace, repository, tag); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileMetaStorage) AddTagHistory(namespace string, repository string, tag string, entry TagHistoryEntry) error {
+	if err := f.MemMetaStorage.AddTagHistory(namespace, repository, tag, entry); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileMetaStorage) SetImages(namespace string, repository string, images []string) error {
+	if err := f.MemMetaStorage.SetImages(namespace, repository, images); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileMetaStorage) DeleteRepository(namespace string, repository string) error {
+	if err := f.MemMetaStorage.DeleteRepository(namespace, repository); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileMetaStorage) Flush() error {
+	return f.save()
+}
+
+func (f *FileMetaStorage) Persistent() bool {
+	return true
+}
@@ -0,0 +1,75 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFileMetaStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crane-meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f, err := ioutil.TempFile("", "crane-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	writeKeyfile(t, f, "key1")
+	options := map[string]string{"datadir": dir, "encryption_keyfile": f.Name()}
+
+	meta, err := NewMetaStorage("file", options, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsPersistent(meta) {
+		t.Error("File meta storage not persistent")
+	}
+	commitTestImage(t, meta, "base", "", 100)
+	commitTestImage(t, meta, "top", "base", 20)
+	meta.SetTmpImageJSON("uploading", "{}")
+	meta.SetImages("user", "repo", []string{"base", "top"})
+	meta.SetTag("user", "repo", "top", "latest")
+	meta.AddTagHistory("user", "repo", "latest", TagHistoryEntry{User: "user", ImageID: "top"})
+	committed, _ := meta.Committed("top")
+
+	sealed, err := ioutil.ReadFile(path.Join(dir, "metadata", metaSnapshotFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("latest")) {
+		t.Error("Metadata stored in plaintext")
+	}
+
+	meta, err = NewMetaStorage("file", options, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imageID, _ := meta.Tag("user", "repo", "latest"); imageID != "top" {
+		t.Errorf("Tag not restored: %q", imageID)
+	}
+	if history, _ := meta.TagHistory("user", "repo", "latest"); len(history) != 1 {
+		t.Errorf("Tag history not restored: %v", history)
+	}
+	if ancestry, _ := meta.Ancestry("top"); len(ancestry) != 2 || ancestry[1] != "base" {
+		t.Errorf("Ancestry not restored: %v", ancestry)
+	}
+	if size, found := meta.AncestrySize("top"); !found || size != 120 {
+		t.Errorf("Wrong ancestry size: %d %v", size, found)
+	}
+	if restored, _ := meta.Committed("top"); !restored.Equal(committed) {
+		t.Errorf("Commit time changed from %v to %v", committed, restored)
+	}
+	if _, found := meta.TmpImageJSON("uploading"); found {
+		t.Error("Tmp metadata restored")
+	}
+
+	// Without the keyfile the sealed metadata is refused
+	if _, err := NewMetaStorage("file", map[string]string{"datadir": dir}, newTestLogger()); err != ErrCodecUnavailable {
+		t.Errorf("Sealed metadata opened without key: %v", err)
+	}
+}
@@ -16,4 +16,5 @@ type FileStorage interface {
 	SetTmpLayer(imageID string, imageJSON string, r io.ReadCloser) (string, int64, error) // Closes r
 	CommitTmpLayer(imageID string) bool
 	DiscardTmpLayer(imageID string) bool
+	DeleteLayer(imageID string) bool
 }
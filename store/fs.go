@@ -0,0 +1,70 @@
+package store
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// fileSystem abstracts the file operations of LocalFileStorage, so tests can simulate crashes
+type fileSystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (file, error)
+	CreateTemp(dir, pattern string) (file, error) // pattern like ioutil.TempFile
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	MkdirAll(path string, perm os.FileMode) error
+	SyncDir(dir string) error // makes creates, renames and removes in dir durable
+	ReadDir(dir string) ([]string, error)
+}
+
+type file interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+	Sync() error
+	Name() string
+}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) CreateTemp(dir, pattern string) (file, error) {
+	return ioutil.TempFile(dir, pattern)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (osFS) ReadDir(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names, nil
+}
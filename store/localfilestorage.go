@@ -3,30 +3,225 @@ package store
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
 	"io"
-	"log"
+	"io/ioutil"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
 )
 
+const (
+	layoutFlat    = 1 // <id>_layer files directly in dataDir
+	layoutSharded = 2 // layers/<xx>/<yy>/<id>_layer, xx and yy from the sha256 of the image id
+
+	layoutMarker = "LAYOUT" // contains the layout version
+)
+
+// Options: datadir, compression (none, gzip or zstd), compression_policy (auto or always),
+// encryption_keyfile and encryption_strict (true or false). Layers are compressed before they are encrypted.
+func init() {
+	RegisterFileStorage("local", func(options map[string]string, logger logrus.FieldLogger) (FileStorage, error) {
+		dataDir := options["datadir"]
+		if dataDir == "" {
+			return nil, errors.New("Option datadir missing")
+		}
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			return nil, err
+		}
+		files, err := withEncryption(NewLocalFileStorage(dataDir, logger), options)
+		if err != nil {
+			return nil, err
+		}
+		return withCompression(files, options)
+	})
+}
+
+// Stores layers in a sharded directory tree below dataDir, a flat data directory is migrated on startup.
+// Uploads are written to a unique tmp file per upload, which is synced before it is renamed
+// to the layer file and the directory is synced after each rename,
+// so a committed layer survives a crash with its full content.
 type LocalFileStorage struct {
+	fs      fileSystem
 	dataDir string
+	log     logrus.FieldLogger
+	mu      sync.Mutex
+	tmp     map[string]string // image id -> tmp file of the latest upload
+	shards  map[string]bool   // shard directories known to exist
 }
 
-func NewLocalFileStorage(dataDir string) *LocalFileStorage {
-	err := os.MkdirAll(dataDir, 0755)
-	log.Printf("Directory created %s", dataDir)
+func NewLocalFileStorage(dataDir string, logger logrus.FieldLogger) *LocalFileStorage {
+	s, err := newLocalFileStorage(osFS{}, dataDir, logger)
 	if err != nil {
 		panic("Could not create local file storage:" + err.Error())
 	}
-	return &LocalFileStorage{
+	return s
+}
+
+// Creates the storage on fs, removes tmp files of uploads interrupted by a crash
+// and migrates a flat data directory to the sharded layout
+func newLocalFileStorage(fs fileSystem, dataDir string, logger logrus.FieldLogger) (*LocalFileStorage, error) {
+	s := &LocalFileStorage{
+		fs:      fs,
 		dataDir: dataDir,
+		log:     logger,
+		tmp:     make(map[string]string),
+		shards:  make(map[string]bool),
+	}
+	for _, dir := range []string{dataDir, s.tmpDir()} {
+		if err := fs.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		if err := s.removeTmpFiles(dir); err != nil {
+			return nil, err
+		}
+	}
+	logger.WithField("dir", dataDir).Debug("Directory created")
+
+	layout, err := s.layout()
+	if err != nil {
+		return nil, err
+	}
+	switch layout {
+	case layoutFlat:
+		if err := s.migrateFlatLayout(); err != nil {
+			return nil, fmt.Errorf("Could not migrate %s to the sharded layout: %v", dataDir, err)
+		}
+	case layoutSharded:
+	default:
+		return nil, fmt.Errorf("Unsupported layout version %d in %s", layout, dataDir)
+	}
+	return s, nil
+}
+
+func (s *LocalFileStorage) tmpDir() string {
+	return path.Join(s.dataDir, "tmp")
+}
+
+func (s *LocalFileStorage) shardDir(imageID string) string {
+	hash := sha256.Sum256([]byte(imageID))
+	h := hex.EncodeToString(hash[:2])
+	return path.Join(s.dataDir, "layers", h[:2], h[2:])
+}
+
+func (s *LocalFileStorage) layerPath(imageID string) string {
+	return path.Join(s.shardDir(imageID), imageID+"_layer")
+}
+
+func (s *LocalFileStorage) removeTmpFiles(dir string) error {
+	names, err := s.fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, name := range names {
+		if strings.HasSuffix(name, ".tmp") {
+			if err := s.fs.Remove(path.Join(dir, name)); err != nil {
+				return err
+			}
+			removed++
+		}
+	}
+	if removed == 0 {
+		return nil
+	}
+	s.log.WithFields(logrus.Fields{"dir": dir, "files": removed}).Info("Removed tmp files of interrupted uploads")
+	return s.fs.SyncDir(dir)
+}
+
+// Reads the layout marker, a data directory without marker has the flat layout
+func (s *LocalFileStorage) layout() (int, error) {
+	f, err := s.fs.OpenFile(path.Join(s.dataDir, layoutMarker), os.O_RDONLY, 0600)
+	if os.IsNotExist(err) {
+		return layoutFlat, nil
+	}
+	if err != nil {
+		return 0, err
 	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// Moves all flat layer files into their shards and writes the layout marker once all moves are durable.
+// An interrupted migration continues on the next start.
+func (s *LocalFileStorage) migrateFlatLayout() error {
+	names, err := s.fs.ReadDir(s.dataDir)
+	if err != nil {
+		return err
+	}
+	moved := 0
+	for _, name := range names {
+		if !strings.HasSuffix(name, "_layer") {
+			continue
+		}
+		imageID := strings.TrimSuffix(name, "_layer")
+		if err := s.ensureShard(imageID); err != nil {
+			return err
+		}
+		if err := s.fs.Rename(path.Join(s.dataDir, name), s.layerPath(imageID)); err != nil {
+			return err
+		}
+		if err := s.fs.SyncDir(s.shardDir(imageID)); err != nil {
+			return err
+		}
+		moved++
+	}
+	if err := s.fs.SyncDir(s.dataDir); err != nil {
+		return err
+	}
+
+	w, err := s.fs.CreateTemp(s.dataDir, layoutMarker+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(strconv.Itoa(layoutSharded) + "\n"))
+	if err == nil {
+		err = w.Sync()
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = s.fs.Rename(w.Name(), path.Join(s.dataDir, layoutMarker))
+	}
+	if err != nil {
+		s.fs.Remove(w.Name())
+		return err
+	}
+	if moved > 0 {
+		s.log.WithFields(logrus.Fields{"dir": s.dataDir, "layers": moved}).Info("Migrated layers to the sharded layout")
+	}
+	return s.fs.SyncDir(s.dataDir)
+}
+
+// Creates the shard directory of imageID and makes its creation durable
+func (s *LocalFileStorage) ensureShard(imageID string) error {
+	dir := s.shardDir(imageID)
+	if s.shards[dir] {
+		return nil
+	}
+	if err := s.fs.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for d := dir; d != s.dataDir; d = path.Dir(d) {
+		if err := s.fs.SyncDir(path.Dir(d)); err != nil {
+			return err
+		}
+	}
+	s.shards[dir] = true
+	return nil
 }
 
 func (s *LocalFileStorage) Layer(imageID string) (ReadCloseSeeker, error) {
-	layerPath := path.Join(s.dataDir, imageID+"_layer")
-	f, err := os.OpenFile(layerPath, os.O_RDONLY, 0600)
+	f, err := s.fs.OpenFile(s.layerPath(imageID), os.O_RDONLY, 0600)
 	if err != nil {
 		return nil, err
 	}
@@ -34,63 +229,141 @@ func (s *LocalFileStorage) Layer(imageID string) (ReadCloseSeeker, error) {
 }
 
 func (s *LocalFileStorage) SetTmpLayer(imageID string, imageJSON string, r io.ReadCloser) (string, int64, error) {
-	layerTmpPath := path.Join(s.dataDir, imageID+"_layer.tmp")
-	w, err := os.OpenFile(layerTmpPath, os.O_RDWR|os.O_CREATE, 0600)
+	defer r.Close()
+	w, err := s.fs.CreateTemp(s.tmpDir(), imageID+"_layer.*.tmp")
 	if err != nil {
 		return "", 0, err
 	}
-	defer w.Close()
-	defer r.Close()
+	s.setTmp(imageID, w.Name())
+
 	//Hashing
 	hash := sha256.New()
 	hash.Write([]byte(imageJSON + "\n"))
-	// make a buffer to keep chunks that are read
-	buf := make([]byte, 4096)
-	var read int64 = 0
-	for {
-		// read a chunk
-		n, err := r.Read(buf)
-		if err != nil && err != io.EOF {
-			return "", 0, err
-		}
-		if n == 0 {
-			break
-		}
+	read, err := io.Copy(io.MultiWriter(w, hash), r)
+	if err == nil {
+		err = w.Sync()
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.discardTmp(imageID, w.Name())
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), read, nil
+}
 
-		// write a chunk
-		if _, err := w.Write(buf[:n]); err != nil {
-			return "", 0, err
-		}
-		if _, err := hash.Write(buf[:n]); err != nil {
-			return "", 0, err
-		}
-		read += int64(n)
+// Removes the tmp file of a failed upload. It stays registered only if a newer upload replaced it meanwhile.
+func (s *LocalFileStorage) discardTmp(imageID string, tmpPath string) {
+	s.mu.Lock()
+	if s.tmp[imageID] == tmpPath {
+		delete(s.tmp, imageID)
 	}
+	s.mu.Unlock()
+	s.fs.Remove(tmpPath)
+}
 
-	hashBytes := hash.Sum(nil)
-	mdStr := hex.EncodeToString(hashBytes)
-	return mdStr, read, nil
+// Registers the tmp file of a new upload, a previous upload of the same image is discarded
+func (s *LocalFileStorage) setTmp(imageID string, tmpPath string) {
+	s.mu.Lock()
+	previous, found := s.tmp[imageID]
+	s.tmp[imageID] = tmpPath
+	s.mu.Unlock()
+	if found {
+		s.fs.Remove(previous)
+	}
 }
 
 func (s *LocalFileStorage) CommitTmpLayer(imageID string) bool {
-	layerTmpPath := path.Join(s.dataDir, imageID+"_layer.tmp")
-	layerPath := path.Join(s.dataDir, imageID+"_layer")
-	r, err := os.OpenFile(layerTmpPath, os.O_RDONLY, 0600)
-	if err != nil {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmpPath, found := s.tmp[imageID]
+	if !found {
 		return false
 	}
-	r.Close()
-	err = os.Rename(layerTmpPath, layerPath)
-	if err != nil {
+	if err := s.ensureShard(imageID); err != nil {
+		s.log.WithField("image", imageID).Errorf("Could not create shard directory: %v", err)
+		return false
+	}
+	if err := s.fs.Rename(tmpPath, s.layerPath(imageID)); err != nil {
+		s.log.WithField("image", imageID).Errorf("Could not commit layer: %v", err)
+		return false
+	}
+	delete(s.tmp, imageID)
+	if err := s.fs.SyncDir(s.shardDir(imageID)); err != nil {
+		s.log.WithField("image", imageID).Errorf("Could not sync layer directory: %v", err)
+		s.fs.Remove(s.layerPath(imageID))
 		return false
 	}
 	return true
 }
+
 func (s *LocalFileStorage) DiscardTmpLayer(imageID string) bool {
-	layerTmpPath := path.Join(s.dataDir, imageID+"_layer.tmp")
-	err := os.Remove(layerTmpPath)
-	if err != nil {
+	s.mu.Lock()
+	tmpPath, found := s.tmp[imageID]
+	delete(s.tmp, imageID)
+	s.mu.Unlock()
+	if !found {
 		return false
 	}
+	return s.fs.Remove(tmpPath) == nil
+}
+
+func (s *LocalFileStorage) DeleteLayer(imageID string) bool {
+	if err := s.fs.Remove(s.layerPath(imageID)); err != nil {
+		return false
+	}
+	s.fs.SyncDir(s.shardDir(imageID))
 	return true
 }
+
+// Returns the image ids of all layers in the shard directories
+func (s *LocalFileStorage) LayerIDs() ([]string, error) {
+	layersDir := path.Join(s.dataDir, "layers")
+	shards, err := s.fs.ReadDir(layersDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var imageIDs []string
+	for _, xx := range shards {
+		subShards, err := s.fs.ReadDir(path.Join(layersDir, xx))
+		if err != nil {
+			return nil, err
+		}
+		for _, yy := range subShards {
+			names, err := s.fs.ReadDir(path.Join(layersDir, xx, yy))
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range names {
+				if strings.HasSuffix(name, "_layer") {
+					imageIDs = append(imageIDs, strings.TrimSuffix(name, "_layer"))
+				}
+			}
+		}
+	}
+	return imageIDs, nil
+}
+
+// Syncs the data directory, so committed layers survive a crash
+func (s *LocalFileStorage) Flush() error {
+	return s.fs.SyncDir(s.dataDir)
+}
+
+// Moves the layer to the quarantine directory, where it is kept for inspection
+func (s *LocalFileStorage) QuarantineLayer(imageID string) error {
+	quarantineDir := path.Join(s.dataDir, "quarantine")
+	if err := s.fs.MkdirAll(quarantineDir, 0755); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(s.layerPath(imageID), path.Join(quarantineDir, imageID+"_layer")); err != nil {
+		return err
+	}
+	if err := s.fs.SyncDir(quarantineDir); err != nil {
+		return err
+	}
+	return s.fs.SyncDir(s.shardDir(imageID))
+}
@@ -0,0 +1,398 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// crashFS is an in-memory fileSystem which only keeps synced state on a simulated crash:
+// file content survives if the file was synced, directory entries if the directory was synced.
+type crashFS struct {
+	mu       sync.Mutex
+	names    map[string]*inode
+	durable  map[string]*inode
+	counter  int
+	failSync bool
+}
+
+type inode struct {
+	data   []byte
+	synced []byte
+}
+
+type crashFile struct {
+	fs     *crashFS
+	name   string
+	node   *inode
+	offset int64
+}
+
+func newCrashFS() *crashFS {
+	return &crashFS{
+		names:   make(map[string]*inode),
+		durable: make(map[string]*inode),
+	}
+}
+
+// Drops everything that was not synced
+func (c *crashFS) crash() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.names = make(map[string]*inode)
+	for name, node := range c.durable {
+		node.data = append([]byte(nil), node.synced...)
+		c.names[name] = node
+	}
+}
+
+func notExist(name string) error {
+	return &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+}
+
+func (c *crashFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	node, found := c.names[name]
+	if !found {
+		if flag&os.O_CREATE == 0 {
+			return nil, notExist(name)
+		}
+		node = &inode{}
+		c.names[name] = node
+	}
+	if flag&os.O_TRUNC != 0 {
+		node.data = nil
+	}
+	return &crashFile{fs: c, name: name, node: node}, nil
+}
+
+func (c *crashFS) CreateTemp(dir, pattern string) (file, error) {
+	c.mu.Lock()
+	c.counter++
+	name := path.Join(dir, strings.Replace(pattern, "*", strconv.Itoa(c.counter), 1))
+	c.mu.Unlock()
+	return c.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+func (c *crashFS) Rename(oldpath, newpath string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	node, found := c.names[oldpath]
+	if !found {
+		return notExist(oldpath)
+	}
+	delete(c.names, oldpath)
+	c.names[newpath] = node
+	return nil
+}
+
+func (c *crashFS) Remove(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.names[name]; !found {
+		return notExist(name)
+	}
+	delete(c.names, name)
+	return nil
+}
+
+func (c *crashFS) MkdirAll(path string, perm os.FileMode) error {
+	return nil
+}
+
+func (c *crashFS) SyncDir(dir string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failSync {
+		return errors.New("sync failed")
+	}
+	for name := range c.durable {
+		if path.Dir(name) == dir {
+			delete(c.durable, name)
+		}
+	}
+	for name, node := range c.names {
+		if path.Dir(name) == dir {
+			c.durable[name] = node
+		}
+	}
+	return nil
+}
+
+func (c *crashFS) ReadDir(dir string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for name := range c.names {
+		if path.Dir(name) == dir {
+			names = append(names, path.Base(name))
+		}
+	}
+	return names, nil
+}
+
+func (f *crashFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *crashFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.node.data = append(f.node.data[:f.offset], p...)
+	f.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (f *crashFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *crashFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.fs.failSync {
+		return errors.New("sync failed")
+	}
+	f.node.synced = append([]byte(nil), f.node.data...)
+	return nil
+}
+
+func (f *crashFile) Close() error {
+	return nil
+}
+
+func (f *crashFile) Name() string {
+	return f.name
+}
+
+// Fails instead of returning EOF, like a dropped connection
+type failingReader struct {
+	io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, _ := f.Reader.Read(p[:1])
+	if n == 0 {
+		return 0, errors.New("connection reset")
+	}
+	return n, nil
+}
+
+func newTestLogger() logrus.FieldLogger {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return logger
+}
+
+func readLayer(t *testing.T, s *LocalFileStorage, imageID string) string {
+	layer, err := s.Layer(imageID)
+	if err != nil {
+		return ""
+	}
+	defer layer.Close()
+	b, _ := ioutil.ReadAll(layer)
+	return string(b)
+}
+
+func TestLocalFileStorageCrash(t *testing.T) {
+	fs := newCrashFS()
+	s, err := newLocalFileStorage(fs, "/data", newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("layer", 1000)
+	if _, _, err := s.SetTmpLayer("committed", "{}", ioutil.NopCloser(strings.NewReader(content))); err != nil {
+		t.Fatal(err)
+	}
+	if !s.CommitTmpLayer("committed") {
+		t.Fatal("Could not commit layer")
+	}
+	if _, _, err := s.SetTmpLayer("uncommitted", "{}", ioutil.NopCloser(strings.NewReader(content))); err != nil {
+		t.Fatal(err)
+	}
+
+	fs.crash()
+	s, err = newLocalFileStorage(fs, "/data", newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layer := readLayer(t, s, "committed"); layer != content {
+		t.Errorf("Committed layer lost or truncated: %d bytes", len(layer))
+	}
+	if _, err := s.Layer("uncommitted"); err == nil {
+		t.Error("Uncommitted layer visible after crash")
+	}
+	if names, _ := fs.ReadDir("/data/tmp"); len(names) != 0 {
+		t.Errorf("Tmp files not cleaned up after crash: %v", names)
+	}
+}
+
+func TestLocalFileStorageFaults(t *testing.T) {
+	fs := newCrashFS()
+	s, err := newLocalFileStorage(fs, "/data", newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An interrupted upload leaves nothing to commit
+	if _, _, err := s.SetTmpLayer("img", "{}", ioutil.NopCloser(&failingReader{bytes.NewReader([]byte("layer"))})); err == nil {
+		t.Fatal("Interrupted upload succeeded")
+	}
+	if s.CommitTmpLayer("img") {
+		t.Error("Interrupted upload committed")
+	}
+
+	// A retried upload replaces the tmp file of the previous one
+	s.SetTmpLayer("img", "{}", ioutil.NopCloser(strings.NewReader("first")))
+	s.SetTmpLayer("img", "{}", ioutil.NopCloser(strings.NewReader("second")))
+	if names, _ := fs.ReadDir("/data/tmp"); len(names) != 1 {
+		t.Errorf("Tmp files of replaced uploads left: %v", names)
+	}
+
+	// Commits fail if the layer can not be made durable
+	fs.failSync = true
+	if _, _, err := s.SetTmpLayer("other", "{}", ioutil.NopCloser(strings.NewReader("layer"))); err == nil {
+		t.Error("Upload succeeded without sync")
+	}
+	if s.CommitTmpLayer("img") {
+		t.Error("Commit succeeded without directory sync")
+	}
+	if _, err := s.Layer("img"); err == nil {
+		t.Error("Layer of failed commit visible")
+	}
+	fs.failSync = false
+	fs.crash()
+	s, _ = newLocalFileStorage(fs, "/data", newTestLogger())
+	if _, err := s.Layer("img"); err == nil {
+		t.Error("Layer without durable commit visible after crash")
+	}
+}
+
+func writeDurable(t *testing.T, fs *crashFS, name string, content string) {
+	f, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(content))
+	f.Sync()
+	fs.SyncDir(path.Dir(name))
+}
+
+func TestLocalFileStorageLayoutMigration(t *testing.T) {
+	fs := newCrashFS()
+	writeDurable(t, fs, "/data/img1_layer", "layer of img1")
+	writeDurable(t, fs, "/data/img2_layer", "layer of img2")
+	writeDurable(t, fs, "/data/img3_layer.tmp", "partial upload")
+
+	s, err := newLocalFileStorage(fs, "/data", newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.crash()
+	s, err = newLocalFileStorage(fs, "/data", newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, imageID := range []string{"img1", "img2"} {
+		if layer := readLayer(t, s, imageID); layer != "layer of "+imageID {
+			t.Errorf("Layer %s not migrated: %q", imageID, layer)
+		}
+		if !strings.HasPrefix(s.layerPath(imageID), "/data/layers/") {
+			t.Errorf("Layer %s not sharded: %s", imageID, s.layerPath(imageID))
+		}
+	}
+	if names, _ := fs.ReadDir("/data"); len(names) != 1 || names[0] != layoutMarker {
+		t.Errorf("Flat files left after migration: %v", names)
+	}
+
+	writeDurable(t, fs, "/data/"+layoutMarker, "3\n")
+	if _, err := newLocalFileStorage(fs, "/data", newTestLogger()); err == nil {
+		t.Error("Unknown layout version accepted")
+	}
+}
+
+func TestLocalFileStorageLayerIDs(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "crane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	s := NewLocalFileStorage(dataDir, newTestLogger())
+	if imageIDs, err := s.LayerIDs(); err != nil || len(imageIDs) != 0 {
+		t.Fatalf("Layers in empty storage: %v %v", imageIDs, err)
+	}
+	for _, imageID := range []string{"img1", "img2"} {
+		s.SetTmpLayer(imageID, "{}", ioutil.NopCloser(strings.NewReader("layer")))
+		s.CommitTmpLayer(imageID)
+	}
+	s.SetTmpLayer("uncommitted", "{}", ioutil.NopCloser(strings.NewReader("layer")))
+	imageIDs, err := s.LayerIDs()
+	sort.Strings(imageIDs)
+	if err != nil || strings.Join(imageIDs, ",") != "img1,img2" {
+		t.Errorf("Wrong layers: %v %v", imageIDs, err)
+	}
+}
+
+func TestLocalFileStorageConcurrentUploadFails(t *testing.T) {
+	fs := newCrashFS()
+	s, err := newLocalFileStorage(fs, "/data", newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	failed := make(chan error)
+	go func() {
+		_, _, err := s.SetTmpLayer("img", "{}", pr)
+		failed <- err
+	}()
+	// The first upload has created its tmp file once it reads
+	pw.Write([]byte("first"))
+	if _, _, err := s.SetTmpLayer("img", "{}", ioutil.NopCloser(strings.NewReader("second"))); err != nil {
+		t.Fatal(err)
+	}
+	pw.CloseWithError(errors.New("Connection reset"))
+	if err := <-failed; err == nil {
+		t.Fatal("Interrupted upload succeeded")
+	}
+
+	if !s.CommitTmpLayer("img") {
+		t.Fatal("Upload discarded by a failed concurrent upload")
+	}
+	layer, err := s.Layer("img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer layer.Close()
+	if b, _ := ioutil.ReadAll(layer); string(b) != "second" {
+		t.Errorf("Wrong layer: %q", b)
+	}
+	if names, _ := fs.ReadDir("/data/tmp"); len(names) != 0 {
+		t.Errorf("Tmp files left: %v", names)
+	}
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+var ErrLayerNotFound = errors.New("Layer not found")
+
+func init() {
+	RegisterFileStorage("memory", func(options map[string]string, logger logrus.FieldLogger) (FileStorage, error) {
+		return NewMemFileStorage(), nil
+	})
+}
+
+// Keeps layers in memory, for tests and small setups
+type MemFileStorage struct {
+	mu        sync.RWMutex
+	layers    map[string][]byte
+	tmpLayers map[string][]byte
+}
+
+func NewMemFileStorage() *MemFileStorage {
+	return &MemFileStorage{
+		layers:    make(map[string][]byte),
+		tmpLayers: make(map[string][]byte),
+	}
+}
+
+func (s *MemFileStorage) Layer(imageID string) (ReadCloseSeeker, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	layer, found := s.layers[imageID]
+	if !found {
+		return nil, ErrLayerNotFound
+	}
+	return nopCloser{bytes.NewReader(layer)}, nil
+}
+
+func (s *MemFileStorage) SetTmpLayer(imageID string, imageJSON string, r io.ReadCloser) (string, int64, error) {
+	defer r.Close()
+	layer, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", 0, err
+	}
+	hash := sha256.New()
+	hash.Write([]byte(imageJSON + "\n"))
+	hash.Write(layer)
+	s.mu.Lock()
+	s.tmpLayers[imageID] = layer
+	s.mu.Unlock()
+	return hex.EncodeToString(hash.Sum(nil)), int64(len(layer)), nil
+}
+
+func (s *MemFileStorage) CommitTmpLayer(imageID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	layer, found := s.tmpLayers[imageID]
+	if !found {
+		return false
+	}
+	s.layers[imageID] = layer
+	delete(s.tmpLayers, imageID)
+	return true
+}
+
+func (s *MemFileStorage) DiscardTmpLayer(imageID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.tmpLayers[imageID]; !found {
+		return false
+	}
+	delete(s.tmpLayers, imageID)
+	return true
+}
+
+func (s *MemFileStorage) DeleteLayer(imageID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.layers[imageID]; !found {
+		return false
+	}
+	delete(s.layers, imageID)
+	return true
+}
+
+func (s *MemFileStorage) LayerIDs() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var imageIDs []string
+	for imageID := range s.layers {
+		imageIDs = append(imageIDs, imageID)
+	}
+	return imageIDs, nil
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
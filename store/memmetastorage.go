@@ -2,28 +2,44 @@ package store
 
 import (
 	"errors"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
 )
 
+// Nothing is written to disk, so there is nothing to seal with NewRecordCipher
+func init() {
+	RegisterMetaStorage("memory", func(options map[string]string, logger logrus.FieldLogger) (MetaStorage, error) {
+		return NewMemMetaStorage(), nil
+	})
+}
+
 type Repository struct {
-	Images []string          // image ids
-	Tags   map[string]string //tag -> imageid
+	Images     []string                     `json:"images"`      // image ids
+	Tags       map[string]string            `json:"tags"`        //tag -> imageid
+	TagHistory map[string][]TagHistoryEntry `json:"tag_history"` //tag -> changes, oldest first
 }
 
 func NewRepository() *Repository {
 	return &Repository{
-		Tags: make(map[string]string),
+		Tags:       make(map[string]string),
+		TagHistory: make(map[string][]TagHistoryEntry),
 	}
 }
 
 type MemMetaStorage struct {
+	mu                  sync.RWMutex
 	imageTmpJsonMap     map[string]string
 	imageTmpChecksumMap map[string]string
 	imageTmpSizeMap     map[string]int64
 	imageJsonMap        map[string]string
 	imageChecksumMap    map[string]string
 	imageSizeMap        map[string]int64
-	imageAncestryMap    map[string]string
+	imageAncestryMap    map[string]*ancestry
+	ancestryWaitingMap  map[string][]string // missing parent -> images whose chain ends with it
+	imageCommittedMap   map[string]time.Time
 	imageTmpAncestryMap map[string]string
+	imageTmpCommitMap   map[string]time.Time // commit times to keep, e.g. of migrated images
 	repositoryMap       map[string]*Repository
 }
 
@@ -35,13 +51,18 @@ func NewMemMetaStorage() *MemMetaStorage {
 		imageJsonMap:        make(map[string]string),
 		imageChecksumMap:    make(map[string]string),
 		imageSizeMap:        make(map[string]int64),
-		imageAncestryMap:    make(map[string]string),
+		imageAncestryMap:    make(map[string]*ancestry),
+		ancestryWaitingMap:  make(map[string][]string),
+		imageCommittedMap:   make(map[string]time.Time),
 		imageTmpAncestryMap: make(map[string]string),
+		imageTmpCommitMap:   make(map[string]time.Time),
 		repositoryMap:       make(map[string]*Repository),
 	}
 }
 
 func (m *MemMetaStorage) CommitTmpImage(imageID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	json, found := m.imageTmpJsonMap[imageID]
 	if !found {
 		return false
@@ -54,83 +75,194 @@ func (m *MemMetaStorage) CommitTmpImage(imageID string) bool {
 	if !found {
 		return false
 	}
-	ancestry, ancestryFound := m.imageTmpAncestryMap[imageID]
+	parentID, parentFound := m.imageTmpAncestryMap[imageID]
 
 	// Insert
 	m.imageJsonMap[imageID] = json
 	m.imageChecksumMap[imageID] = checksum
 	m.imageSizeMap[imageID] = size
-	if ancestryFound {
-		m.imageAncestryMap[imageID] = ancestry
+	if committed, found := m.imageTmpCommitMap[imageID]; found {
+		m.imageCommittedMap[imageID] = committed
+	} else {
+		m.imageCommittedMap[imageID] = time.Now()
 	}
+	m.imageAncestryMap[imageID] = m.materializeAncestry(imageID, size, parentID, parentFound)
+	m.completeAncestries(imageID)
 
 	// Remove tmp
 	delete(m.imageTmpJsonMap, imageID)
 	delete(m.imageTmpChecksumMap, imageID)
 	delete(m.imageTmpSizeMap, imageID)
-	if ancestryFound {
+	delete(m.imageTmpCommitMap, imageID)
+	if parentFound {
 		delete(m.imageTmpAncestryMap, imageID)
 	}
 	return true
 }
+
+// Ancestry chain of a committed image, parents are immutable once committed
+type ancestry struct {
+	imageIDs []string // the image followed by its parents
+	size     int64
+	missing  string // last parent of the chain if it is not committed yet, its size is not included
+}
+
+// Builds the chain of imageID on top of the chain of its parent, m.mu must be held.
+// If the chain ends with a parent which is not committed yet, it is completed once the parent commits.
+func (m *MemMetaStorage) materializeAncestry(imageID string, size int64, parentID string, hasParent bool) *ancestry {
+	chain := &ancestry{imageIDs: []string{imageID}, size: size}
+	if !hasParent {
+		return chain
+	}
+	parent, found := m.imageAncestryMap[parentID]
+	if !found {
+		parent = &ancestry{imageIDs: []string{parentID}, missing: parentID}
+	}
+	chain.imageIDs = append(chain.imageIDs, parent.imageIDs...)
+	chain.size += parent.size
+	chain.missing = parent.missing
+	if chain.missing != "" {
+		m.ancestryWaitingMap[chain.missing] = append(m.ancestryWaitingMap[chain.missing], imageID)
+	}
+	return chain
+}
+
+// Appends the chain of the just committed imageID to the chains ending with it, m.mu must be held
+func (m *MemMetaStorage) completeAncestries(imageID string) {
+	waiting := m.ancestryWaitingMap[imageID]
+	delete(m.ancestryWaitingMap, imageID)
+	parent := m.imageAncestryMap[imageID]
+	for _, childID := range waiting {
+		child, found := m.imageAncestryMap[childID]
+		if !found || child.missing != imageID {
+			continue
+		}
+		imageIDs := make([]string, 0, len(child.imageIDs)-1+len(parent.imageIDs))
+		imageIDs = append(imageIDs, child.imageIDs[:len(child.imageIDs)-1]...)
+		m.imageAncestryMap[childID] = &ancestry{
+			imageIDs: append(imageIDs, parent.imageIDs...),
+			size:     child.size + parent.size,
+			missing:  parent.missing,
+		}
+		if parent.missing != "" {
+			m.ancestryWaitingMap[parent.missing] = append(m.ancestryWaitingMap[parent.missing], childID)
+		}
+	}
+}
 func (m *MemMetaStorage) DiscardTmpImage(imageID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	// Remove tmp
 	delete(m.imageTmpJsonMap, imageID)
 	delete(m.imageTmpChecksumMap, imageID)
 	delete(m.imageTmpSizeMap, imageID)
 	delete(m.imageTmpAncestryMap, imageID)
+	delete(m.imageTmpCommitMap, imageID)
+	return true
+}
+
+// Removes a committed image
+func (m *MemMetaStorage) DeleteImage(imageID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, found := m.imageJsonMap[imageID]; !found {
+		return false
+	}
+	delete(m.imageJsonMap, imageID)
+	delete(m.imageChecksumMap, imageID)
+	delete(m.imageSizeMap, imageID)
+	delete(m.imageAncestryMap, imageID)
+	delete(m.imageCommittedMap, imageID)
 	return true
 }
 
+func (m *MemMetaStorage) Committed(imageID string) (time.Time, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	committed, found := m.imageCommittedMap[imageID]
+	return committed, found
+}
+
+func (m *MemMetaStorage) SetTmpCommitted(imageID string, committed time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.imageTmpCommitMap[imageID] = committed
+	return nil
+}
+
 func (m *MemMetaStorage) SetTmpImageJSON(imageID string, json string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.imageTmpJsonMap[imageID] = json
 	return nil
 }
 func (m *MemMetaStorage) ImageJSON(imageID string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	json, found := m.imageJsonMap[imageID]
 	return json, found
 }
 func (m *MemMetaStorage) TmpImageJSON(imageID string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	json, found := m.imageTmpJsonMap[imageID]
 	return json, found
 }
 
 func (m *MemMetaStorage) SetTmpChecksum(imageID string, checksum string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.imageTmpChecksumMap[imageID] = checksum
 	return nil
 }
 
 func (m *MemMetaStorage) TmpChecksum(imageID string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	chs, found := m.imageTmpChecksumMap[imageID]
 	return chs, found
 }
 func (m *MemMetaStorage) Checksum(imageID string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	chs, found := m.imageChecksumMap[imageID]
 	return chs, found
 }
 
 func (m *MemMetaStorage) SetTmpSize(imageID string, size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.imageTmpSizeMap[imageID] = size
 	return nil
 }
 func (m *MemMetaStorage) Size(imageID string) (int64, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	size, found := m.imageSizeMap[imageID]
 	return size, found
 }
 
 func (m *MemMetaStorage) Tags(namespace string, repository string) (map[string]string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	repo, found := m.repositoryMap[namespace+"/"+repository]
 	if !found {
 		return nil, false
 	}
 	if len(repo.Tags) > 0 {
-		return repo.Tags, true
+		tags := make(map[string]string, len(repo.Tags))
+		for tag, imageID := range repo.Tags {
+			tags[tag] = imageID
+		}
+		return tags, true
 	} else {
 		return nil, false
 	}
 }
 
 func (m *MemMetaStorage) Tag(namespace string, repository string, tag string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	repo, found := m.repositoryMap[namespace+"/"+repository]
 	if !found {
 		return "", false
@@ -140,6 +272,8 @@ func (m *MemMetaStorage) Tag(namespace string, repository string, tag string) (s
 }
 
 func (m *MemMetaStorage) SetTag(namespace string, repository string, imageID string, tag string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	repo, found := m.repositoryMap[namespace+"/"+repository]
 	if !found {
 		repo = NewRepository()
@@ -149,7 +283,46 @@ func (m *MemMetaStorage) SetTag(namespace string, repository string, imageID str
 	return nil
 }
 
+func (m *MemMetaStorage) DeleteTag(namespace string, repository string, tag string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	repo, found := m.repositoryMap[namespace+"/"+repository]
+	if !found {
+		return errors.New("Repository not found")
+	}
+	if _, found := repo.Tags[tag]; !found {
+		return errors.New("Tag not found")
+	}
+	delete(repo.Tags, tag)
+	return nil
+}
+
+func (m *MemMetaStorage) TagHistory(namespace string, repository string, tag string) ([]TagHistoryEntry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	repo, found := m.repositoryMap[namespace+"/"+repository]
+	if !found {
+		return nil, false
+	}
+	history, found := repo.TagHistory[tag]
+	return history, found
+}
+
+func (m *MemMetaStorage) AddTagHistory(namespace string, repository string, tag string, entry TagHistoryEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	repo, found := m.repositoryMap[namespace+"/"+repository]
+	if !found {
+		repo = NewRepository()
+		m.repositoryMap[namespace+"/"+repository] = repo
+	}
+	repo.TagHistory[tag] = append(repo.TagHistory[tag], entry)
+	return nil
+}
+
 func (m *MemMetaStorage) SetImages(namespace string, repository string, images []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	repo, found := m.repositoryMap[namespace+"/"+repository]
 	if !found {
 		repo = NewRepository()
@@ -159,6 +332,8 @@ func (m *MemMetaStorage) SetImages(namespace string, repository string, images [
 	return nil
 }
 func (m *MemMetaStorage) Images(namespace string, repository string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	repo, found := m.repositoryMap[namespace+"/"+repository]
 	if !found {
 		return nil, errors.New("Repository not found")
@@ -166,20 +341,60 @@ func (m *MemMetaStorage) Images(namespace string, repository string) ([]string,
 	return repo.Images, nil
 }
 
+func (m *MemMetaStorage) DeleteRepository(namespace string, repository string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, found := m.repositoryMap[namespace+"/"+repository]; !found {
+		return errors.New("Repository not found")
+	}
+	delete(m.repositoryMap, namespace+"/"+repository)
+	return nil
+}
+
+func (m *MemMetaStorage) Repositories() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var repositories []string
+	for name := range m.repositoryMap {
+		repositories = append(repositories, name)
+	}
+	return repositories
+}
+
+func (m *MemMetaStorage) ImageIDs() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var imageIDs []string
+	for imageID := range m.imageJsonMap {
+		imageIDs = append(imageIDs, imageID)
+	}
+	return imageIDs
+}
+
 func (m *MemMetaStorage) Ancestry(imageID string) ([]string, error) {
-	var ancestryArr []string
-	for {
-		ancestryArr = append(ancestryArr, imageID)
-		if parentID, found := m.imageAncestryMap[imageID]; found {
-			imageID = parentID
-		} else {
-			break
-		}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	chain, found := m.imageAncestryMap[imageID]
+	if !found {
+		return []string{imageID}, nil
+	}
+	return append([]string(nil), chain.imageIDs...), nil
+}
+
+func (m *MemMetaStorage) AncestrySize(imageID string) (int64, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	chain, found := m.imageAncestryMap[imageID]
+	// The size of a chain with a parent which is not committed yet is incomplete
+	if !found || chain.missing != "" {
+		return 0, false
 	}
-	return ancestryArr, nil
+	return chain.size, true
 }
 
 func (m *MemMetaStorage) SetTmpAncestry(imageID string, parentImageID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.imageTmpAncestryMap[imageID] = parentImageID
 	return nil
 }
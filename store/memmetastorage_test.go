@@ -0,0 +1,79 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func commitTestImage(t *testing.T, m MetaStorage, imageID string, parentID string, size int64) {
+	m.SetTmpImageJSON(imageID, "{}")
+	m.SetTmpChecksum(imageID, "checksum")
+	m.SetTmpSize(imageID, size)
+	if parentID != "" {
+		m.SetTmpAncestry(imageID, parentID)
+	}
+	if !m.CommitTmpImage(imageID) {
+		t.Fatalf("Could not commit image %s", imageID)
+	}
+}
+
+func TestMemMetaStorageAncestry(t *testing.T) {
+	m := NewMemMetaStorage()
+	commitTestImage(t, m, "base", "", 100)
+	commitTestImage(t, m, "middle", "base", 20)
+	commitTestImage(t, m, "top", "middle", 3)
+
+	ancestry, err := m.Ancestry("top")
+	if err != nil || !reflect.DeepEqual(ancestry, []string{"top", "middle", "base"}) {
+		t.Errorf("Wrong ancestry: %v %v", ancestry, err)
+	}
+	if size, found := m.AncestrySize("top"); !found || size != 123 {
+		t.Errorf("Wrong ancestry size: %d", size)
+	}
+	if size, found := m.AncestrySize("base"); !found || size != 100 {
+		t.Errorf("Wrong ancestry size of base image: %d", size)
+	}
+
+	// The chain is materialized, deleting a parent does not change it
+	ancestry[1] = "modified"
+	m.DeleteImage("middle")
+	if ancestry, _ := m.Ancestry("top"); !reflect.DeepEqual(ancestry, []string{"top", "middle", "base"}) {
+		t.Errorf("Ancestry changed: %v", ancestry)
+	}
+	if _, found := m.AncestrySize("middle"); found {
+		t.Error("Ancestry of deleted image found")
+	}
+	if ancestry, _ := m.Ancestry("unknown"); !reflect.DeepEqual(ancestry, []string{"unknown"}) {
+		t.Errorf("Wrong ancestry of unknown image: %v", ancestry)
+	}
+}
+
+func TestMemMetaStorageAncestryParentCommittedLater(t *testing.T) {
+	m := NewMemMetaStorage()
+	commitTestImage(t, m, "top", "middle", 3)
+	commitTestImage(t, m, "other", "middle", 4)
+	commitTestImage(t, m, "middle", "base", 20)
+	if ancestry, _ := m.Ancestry("top"); !reflect.DeepEqual(ancestry, []string{"top", "middle", "base"}) {
+		t.Errorf("Wrong ancestry before base commit: %v", ancestry)
+	}
+	if _, found := m.AncestrySize("top"); found {
+		t.Error("Ancestry size of incomplete chain found")
+	}
+	commitTestImage(t, m, "base", "", 100)
+
+	for imageID, expected := range map[string][]string{
+		"top":    {"top", "middle", "base"},
+		"other":  {"other", "middle", "base"},
+		"middle": {"middle", "base"},
+	} {
+		if ancestry, _ := m.Ancestry(imageID); !reflect.DeepEqual(ancestry, expected) {
+			t.Errorf("Wrong ancestry of %s: %v", imageID, ancestry)
+		}
+	}
+	if size, found := m.AncestrySize("top"); !found || size != 123 {
+		t.Errorf("Wrong ancestry size: %d", size)
+	}
+	if len(m.ancestryWaitingMap) != 0 {
+		t.Errorf("Completed chains still waiting: %v", m.ancestryWaitingMap)
+	}
+}
@@ -1,5 +1,17 @@
 package store
 
+import (
+	"time"
+)
+
+// Records a change of a tag
+type TagHistoryEntry struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user"`
+	OldImageID string    `json:"old_image,omitempty"`
+	ImageID    string    `json:"image"`
+}
+
 // Interface for meta storage
 type MetaStorage interface {
 	ImageJSON(imageID string) (string, bool)
@@ -9,18 +21,26 @@ type MetaStorage interface {
 	TmpChecksum(imageID string) (string, bool)
 	SetTmpChecksum(imageID string, checksum string) error
 	Size(imageID string) (int64, bool)
+	Committed(imageID string) (time.Time, bool) // time of CommitTmpImage, unless set by SetTmpCommitted
+	SetTmpCommitted(imageID string, committed time.Time) error
 	SetTmpSize(imageID string, size int64) error
 
-	Ancestry(imageID string) ([]string, error)
+	Ancestry(imageID string) ([]string, error) // the image followed by its parents
+	AncestrySize(imageID string) (int64, bool) // cumulative size of the image and its parents, false until all are committed
 	SetTmpAncestry(imageID string, parentImageID string) error
 	Tags(namespace string, repository string) (map[string]string, bool)
 	Tag(namespace string, repository string, tag string) (string, bool)
 	SetTag(namespace string, repository string, imageID string, tag string) error
+	TagHistory(namespace string, repository string, tag string) ([]TagHistoryEntry, bool)
+	AddTagHistory(namespace string, repository string, tag string, entry TagHistoryEntry) error
 	SetImages(namespace string, repository string, images []string) error
 	Images(namespace string, repository string) ([]string, error)
-	// DeleteTag(namespace string, repository string, tag string) error
-	// DeleteRepository(namespace string, repository string) error
+	DeleteTag(namespace string, repository string, tag string) error
+	DeleteRepository(namespace string, repository string) error
+	Repositories() []string // namespace/repository
+	ImageIDs() []string     // committed images
 
 	CommitTmpImage(imageID string) bool
 	DiscardTmpImage(imageID string) bool
+	DeleteImage(imageID string) bool
 }
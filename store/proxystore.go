@@ -11,3 +11,31 @@ func NewProxyStore(meta MetaStorage, file FileStorage) *ProxyStore {
 		FileStorage: file,
 	}
 }
+
+// Flushes the meta and file storage
+func (p *ProxyStore) Flush() error {
+	if err := Flush(p.MetaStorage); err != nil {
+		return err
+	}
+	return Flush(p.FileStorage)
+}
+
+// Reports whether the meta storage is persistent
+func (p *ProxyStore) Persistent() bool {
+	return IsPersistent(p.MetaStorage)
+}
+
+// Lists the layers of the file storage
+func (p *ProxyStore) LayerIDs() ([]string, error) {
+	return LayerIDs(p.FileStorage)
+}
+
+// Reads a layer of the file storage bypassing caches
+func (p *ProxyStore) UncachedLayer(imageID string) (ReadCloseSeeker, error) {
+	return UncachedLayer(p.FileStorage, imageID)
+}
+
+// Quarantines a layer of the file storage
+func (p *ProxyStore) QuarantineLayer(imageID string) error {
+	return QuarantineLayer(p.FileStorage, imageID)
+}
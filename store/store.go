@@ -1,6 +1,79 @@
 package store
 
+import (
+	"errors"
+)
+
 type Store interface {
 	MetaStorage
 	FileStorage
 }
+
+// Implemented by storages that buffer writes
+type Flusher interface {
+	Flush() error
+}
+
+// Flushes s if it implements Flusher
+func Flush(s interface{}) error {
+	if f, ok := s.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Implemented by meta storages which keep their data across restarts
+type Persister interface {
+	Persistent() bool
+}
+
+// Reports whether s keeps its data across restarts, storages not implementing Persister do not
+func IsPersistent(s interface{}) bool {
+	if p, ok := s.(Persister); ok {
+		return p.Persistent()
+	}
+	return false
+}
+
+// Implemented by file storages which can enumerate their committed layers
+type LayerLister interface {
+	LayerIDs() ([]string, error)
+}
+
+var ErrListUnsupported = errors.New("Storage can not list layers")
+
+// Returns the image ids of all committed layers of s if it implements LayerLister
+func LayerIDs(s interface{}) ([]string, error) {
+	if l, ok := s.(LayerLister); ok {
+		return l.LayerIDs()
+	}
+	return nil, ErrListUnsupported
+}
+
+// Implemented by file storages which cache layers or wrap a storage which does
+type UncachedReader interface {
+	UncachedLayer(imageID string) (ReadCloseSeeker, error)
+}
+
+// Reads the layer of imageID from s bypassing caches, so the data at rest is read
+func UncachedLayer(s FileStorage, imageID string) (ReadCloseSeeker, error) {
+	if u, ok := s.(UncachedReader); ok {
+		return u.UncachedLayer(imageID)
+	}
+	return s.Layer(imageID)
+}
+
+// Implemented by file storages which can set corrupted layers aside instead of deleting them
+type Quarantiner interface {
+	QuarantineLayer(imageID string) error
+}
+
+var ErrQuarantineUnsupported = errors.New("Storage does not support quarantine")
+
+// Quarantines the layer of imageID if s implements Quarantiner
+func QuarantineLayer(s interface{}, imageID string) error {
+	if q, ok := s.(Quarantiner); ok {
+		return q.QuarantineLayer(imageID)
+	}
+	return ErrQuarantineUnsupported
+}
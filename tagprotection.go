@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"path"
+)
+
+var ErrTagProtected = errors.New("Tag is protected")
+
+// TagRule protects tags matching Pattern in repositories matching Repository.
+// Both are glob patterns as understood by path.Match, Repository is matched against "namespace/repository".
+type TagRule struct {
+	Repository string   `json:"repository" yaml:"repository"`
+	Pattern    string   `json:"pattern" yaml:"pattern"`
+	Immutable  bool     `json:"immutable" yaml:"immutable"` // Tag can not be changed once set
+	Users      []string `json:"users" yaml:"users"`         // Only these users may set the tag, empty allows everyone
+}
+
+func (t TagRule) matches(namespace, repository, tag string) bool {
+	repoMatch, err := path.Match(t.Repository, namespace+"/"+repository)
+	if err != nil || !repoMatch {
+		return false
+	}
+	tagMatch, err := path.Match(t.Pattern, tag)
+	return err == nil && tagMatch
+}
+
+func (t TagRule) allowsUser(user string) bool {
+	if len(t.Users) == 0 {
+		return true
+	}
+	for _, u := range t.Users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the glob patterns of rules
+func ValidateTagRules(rules []TagRule) error {
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Repository, ""); err != nil {
+			return errors.New("Invalid repository pattern " + rule.Repository)
+		}
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return errors.New("Invalid tag pattern " + rule.Pattern)
+		}
+	}
+	return nil
+}
+
+func (r *Registry) SetTagRules(rules []TagRule) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tagRules = rules
+}
+
+// Sets tag if user may point it to imageID, returns ErrTagProtected otherwise.
+// The check and the change are atomic, so concurrent pushes can not both change an immutable tag.
+func (r *Registry) SetProtectedTag(user, namespace, repository, imageID, tag string) error {
+	r.tagMu.Lock()
+	defer r.tagMu.Unlock()
+	if err := r.CheckTagProtection(user, namespace, repository, imageID, tag); err != nil {
+		return err
+	}
+	return r.SetTag(user, namespace, repository, imageID, tag)
+}
+
+// Checks if user may point tag to imageID, returns ErrTagProtected if a rule forbids it.
+// Use SetProtectedTag to set the tag, the check alone can be outdated when the tag is set.
+func (r *Registry) CheckTagProtection(user, namespace, repository, imageID, tag string) error {
+	r.mu.Lock()
+	rules := r.tagRules
+	r.mu.Unlock()
+
+	for _, rule := range rules {
+		if !rule.matches(namespace, repository, tag) {
+			continue
+		}
+		if !rule.allowsUser(user) {
+			return ErrTagProtected
+		}
+		if rule.Immutable {
+			if current, found := r.Tag(namespace, repository, tag); found && current != imageID {
+				return ErrTagProtected
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"github.com/blang/crane/auth"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTagProtection(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	r.SetTagRules([]TagRule{
+		{Repository: "*/*", Pattern: "v*", Immutable: true},
+		{Repository: "team/*", Pattern: "prod", Users: []string{"deployer"}},
+	})
+	r.SetTag("user", "team", "app", "img1", "v1.0.0")
+
+	if err := r.CheckTagProtection("user", "team", "app", "img2", "v1.0.0"); err != ErrTagProtected {
+		t.Errorf("Immutable tag could be changed: %v", err)
+	}
+	if err := r.CheckTagProtection("user", "team", "app", "img1", "v1.0.0"); err != nil {
+		t.Errorf("Immutable tag could not be set to same image: %v", err)
+	}
+	if err := r.CheckTagProtection("user", "team", "app", "img2", "v1.0.1"); err != nil {
+		t.Errorf("New immutable tag could not be set: %v", err)
+	}
+	if err := r.CheckTagProtection("user", "team", "app", "img2", "prod"); err != ErrTagProtected {
+		t.Errorf("Unprivileged user could set prod: %v", err)
+	}
+	if err := r.CheckTagProtection("deployer", "team", "app", "img2", "prod"); err != nil {
+		t.Errorf("Privileged user could not set prod: %v", err)
+	}
+	if err := r.CheckTagProtection("user", "other", "app", "img2", "prod"); err != nil {
+		t.Errorf("Rule applied to wrong repository: %v", err)
+	}
+}
+
+func TestDeleteRepositoryWithProtectedTags(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	authenticator := auth.NewLocalAuthenticator()
+	authenticator.SetAdmins([]string{"admin"})
+	r.authenticator = authenticator
+
+	pushTestImage(t, r, "", "img1")
+	r.SetImages("team", "app", []string{"img1"})
+	r.SetTag("user", "team", "app", "img1", "v1.0.0")
+	r.SetTagRules([]TagRule{{Repository: "*/*", Pattern: "v*", Immutable: true}})
+
+	if err := r.DeleteRepository("team", "team", "app"); err != ErrTagProtected {
+		t.Errorf("Repository with immutable tag deleted: %v", err)
+	}
+	if _, found := r.Tag("team", "app", "v1.0.0"); !found {
+		t.Error("Immutable tag deleted")
+	}
+	if err := r.DeleteRepository("admin", "team", "app"); err != nil {
+		t.Errorf("Admin could not delete repository: %v", err)
+	}
+}
+
+func TestImmutableTagConcurrentPushes(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	r.SetTagRules([]TagRule{{Repository: "*/*", Pattern: "v*", Immutable: true}})
+
+	var wg sync.WaitGroup
+	var set int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if r.SetProtectedTag("user", "team", "app", fmt.Sprintf("img%d", i), "v1.0.0") == nil {
+				atomic.AddInt32(&set, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if set != 1 {
+		t.Errorf("Immutable tag set %d times", set)
+	}
+
+	// A push whose pending tag was protected meanwhile fails, its image is left unreachable
+	r.BeginPush("token", "user", "team", "app", []string{"img1"})
+	pushTestImage(t, r, "token", "img1")
+	if err := r.PushTag("token", "team", "app", "img1", "v2.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetProtectedTag("user", "team", "app", "img2", "v2.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.FinishPush("user", "team", "app"); err != ErrTagProtected {
+		t.Errorf("Push with protected tag finished: %v", err)
+	}
+	if imageID, _ := r.Tag("team", "app", "v2.0.0"); imageID != "img2" {
+		t.Errorf("Immutable tag changed to %s", imageID)
+	}
+	if images, _ := r.Images("team", "app"); len(images) != 0 {
+		t.Errorf("Images of push with protected tag visible: %v", images)
+	}
+}
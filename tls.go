@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the certificate of certFile and keyFile and reloads it when one of the files changes
+type certReloader struct {
+	certFile      string
+	keyFile       string
+	checkInterval time.Duration
+	log           logrus.FieldLogger
+
+	mu          sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastCheck   time.Time
+}
+
+func newCertReloader(certFile, keyFile string, log logrus.FieldLogger) (*certReloader, error) {
+	c := &certReloader{
+		certFile:      certFile,
+		keyFile:       keyFile,
+		checkInterval: 5 * time.Second,
+		log:           log,
+	}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) reload() error {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil && certInfo.ModTime().Equal(c.certModTime) && keyInfo.ModTime().Equal(c.keyModTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil {
+		c.log.WithField("cert", c.certFile).Info("TLS certificate reloaded")
+	}
+	c.cert = &cert
+	c.certModTime = certInfo.ModTime()
+	c.keyModTime = keyInfo.ModTime()
+	return nil
+}
+
+// Implements tls.Config.GetCertificate, keeps serving the old certificate if reloading fails
+func (c *certReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.lastCheck) >= c.checkInterval {
+		c.lastCheck = time.Now()
+		if err := c.reload(); err != nil {
+			c.log.WithField("cert", c.certFile).Errorf("Could not reload TLS certificate: %v", err)
+		}
+	}
+	return c.cert, nil
+}
+
+// Creates the server tls config with certificate reloading and optional client certificate authentication
+func NewTLSConfig(config TLSConfig, log logrus.FieldLogger) (*tls.Config, error) {
+	reloader, err := newCertReloader(config.Cert, config.Key, log)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if config.ClientCA == "" {
+		return tlsConfig, nil
+	}
+	pem, err := ioutil.ReadFile(config.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("No certificates found in " + config.ClientCA)
+	}
+	tlsConfig.ClientCAs = pool
+	switch config.ClientAuth {
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional", "":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, errors.New("Unknown client_auth " + config.ClientAuth)
+	}
+	return tlsConfig, nil
+}
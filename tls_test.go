@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+var testSerial int64
+
+// Creates a certificate for cn signed by parent, a nil parent creates a self signed CA
+func newTestCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return cert, key, certPEM, keyPEM
+}
+
+func writeTestFile(t *testing.T, filename string, b []byte) {
+	if err := ioutil.WriteFile(filename, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crane-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+	_, _, certPEM, keyPEM := newTestCert(t, "first", nil, nil)
+	writeTestFile(t, certFile, certPEM)
+	writeTestFile(t, keyFile, keyPEM)
+
+	reloader, err := newCertReloader(certFile, keyFile, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader.checkInterval = 0
+	first, _ := reloader.GetCertificate(nil)
+
+	second, _, certPEM, keyPEM := newTestCert(t, "second", nil, nil)
+	writeTestFile(t, certFile, certPEM)
+	writeTestFile(t, keyFile, keyPEM)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	os.Chtimes(keyFile, future, future)
+	cert, _ := reloader.GetCertificate(nil)
+	if !bytes.Equal(cert.Certificate[0], second.Raw) {
+		t.Errorf("Certificate not reloaded")
+	}
+
+	// Broken files keep the current certificate
+	writeTestFile(t, keyFile, []byte("broken"))
+	os.Chtimes(keyFile, future.Add(time.Minute), future.Add(time.Minute))
+	if cert, _ := reloader.GetCertificate(nil); cert == first || !bytes.Equal(cert.Certificate[0], second.Raw) {
+		t.Errorf("Broken certificate replaced the current one")
+	}
+}
+
+func TestClientCertificateAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crane-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey, caPEM, _ := newTestCert(t, "ca", nil, nil)
+	_, _, serverPEM, serverKeyPEM := newTestCert(t, "server", ca, caKey)
+	_, _, clientPEM, clientKeyPEM := newTestCert(t, "alice", ca, caKey)
+	config := TLSConfig{
+		Cert:     path.Join(dir, "server.pem"),
+		Key:      path.Join(dir, "server-key.pem"),
+		ClientCA: path.Join(dir, "ca.pem"),
+	}
+	writeTestFile(t, config.Cert, serverPEM)
+	writeTestFile(t, config.Key, serverKeyPEM)
+	writeTestFile(t, config.ClientCA, caPEM)
+
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	tlsConfig, err := NewTLSConfig(config, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: NewRegistryAPI(r, newTestLogger())}
+	go server.Serve(listener)
+	defer server.Close()
+	url := "https://" + listener.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientCert, err := tls.X509KeyPair(clientPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(certs []tls.Certificate) int {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		req, _ := http.NewRequest("PUT", url+"/v1/repositories/alice/repo/", bytes.NewBufferString("[]"))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := put([]tls.Certificate{clientCert}); status != http.StatusOK {
+		t.Errorf("Client certificate not accepted: %d", status)
+	}
+	if status := put(nil); status != http.StatusUnauthorized {
+		t.Errorf("Request without credentials accepted: %d", status)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	ErrLayerTooLarge       = errors.New("Layer exceeds the maximum layer size")
+	ErrInsufficientStorage = errors.New("Not enough free disk space for uploads")
+)
+
+// Reasons of rejected uploads
+const (
+	RejectLayerSize = "layer_size"
+	RejectDiskSpace = "disk_space"
+	RejectQuota     = "quota"
+)
+
+var rejectReasons = []string{RejectLayerSize, RejectDiskSpace, RejectQuota}
+
+// Limits of layer uploads, zero values are unlimited
+type UploadLimits struct {
+	MaxLayerSize int64 `yaml:"max_layer_size"` // Bytes of a single layer
+	MinFreeSpace int64 `yaml:"min_free_space"` // Bytes that have to stay free in the storage datadir, new uploads are rejected below
+}
+
+func (u UploadLimits) Validate() error {
+	if u.MaxLayerSize < 0 || u.MinFreeSpace < 0 {
+		return errors.New("limits must not be negative")
+	}
+	return nil
+}
+
+// Sets the upload limits, the free space is checked on the file system of dataDir
+func (r *Registry) SetUploadLimits(limits UploadLimits, dataDir string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.uploadLimits = limits
+	r.dataDir = dataDir
+}
+
+// Returns the number of rejected uploads by reason
+func (r *Registry) RejectedUploads() map[string]uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rejected := make(map[string]uint64)
+	for _, reason := range rejectReasons {
+		rejected[reason] = r.rejectedUploads[reason]
+	}
+	return rejected
+}
+
+func (r *Registry) rejectUpload(err error) {
+	reasons := map[error]string{
+		ErrLayerTooLarge:       RejectLayerSize,
+		ErrInsufficientStorage: RejectDiskSpace,
+		ErrQuotaExceeded:       RejectQuota,
+	}
+	if reason, found := reasons[err]; found {
+		r.mu.Lock()
+		r.rejectedUploads[reason]++
+		r.mu.Unlock()
+	}
+}
+
+// Checks the free space watermark before an upload starts.
+// If the free space can not be determined the upload is allowed.
+func (r *Registry) checkFreeSpace() error {
+	r.mu.Lock()
+	limits, dataDir := r.uploadLimits, r.dataDir
+	r.mu.Unlock()
+	if limits.MinFreeSpace == 0 || dataDir == "" {
+		return nil
+	}
+	free, err := r.freeSpace(dataDir)
+	if err != nil {
+		r.log.WithField("dir", dataDir).Warnf("Could not determine free disk space: %v", err)
+		return nil
+	}
+	if free < limits.MinFreeSpace {
+		r.log.WithField("dir", dataDir).Warnf("Rejecting upload, %d bytes free, %d required", free, limits.MinFreeSpace)
+		return ErrInsufficientStorage
+	}
+	return nil
+}
+
+// Limits the layer upload to the maximum layer size
+func (r *Registry) layerSizeReader(reader io.ReadCloser) io.ReadCloser {
+	r.mu.Lock()
+	maxLayerSize := r.uploadLimits.MaxLayerSize
+	r.mu.Unlock()
+	if maxLayerSize == 0 {
+		return reader
+	}
+	return &limitedReadCloser{
+		ReadCloser: reader,
+		remaining:  maxLayerSize,
+		err:        ErrLayerTooLarge,
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestUploadLimits(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+	free := int64(1000)
+	r.freeSpace = func(dir string) (int64, error) { return free, nil }
+	r.SetUploadLimits(UploadLimits{MaxLayerSize: 20, MinFreeSpace: 500}, "/data")
+
+	r.SetTmpImageJSON("img1", "{}")
+	err := r.SetTmpLayer("", "img1", "{}", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 21))))
+	if err != ErrLayerTooLarge {
+		t.Fatalf("Expected layer too large, got %v", err)
+	}
+	if _, found := r.store.TmpChecksum("img1"); found {
+		t.Error("Layer exceeding the maximum size was stored")
+	}
+	if err := r.SetTmpLayer("", "img1", "{}", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 20)))); err != nil {
+		t.Errorf("Layer of maximum size rejected: %v", err)
+	}
+
+	free = 499
+	if err := r.SetTmpLayer("", "img1", "{}", ioutil.NopCloser(strings.NewReader("x"))); err != ErrInsufficientStorage {
+		t.Errorf("Expected insufficient storage, got %v", err)
+	}
+	rejected := r.RejectedUploads()
+	if rejected[RejectLayerSize] != 1 || rejected[RejectDiskSpace] != 1 || rejected[RejectQuota] != 0 {
+		t.Errorf("Wrong rejected uploads: %v", rejected)
+	}
+}